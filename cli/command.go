@@ -2,17 +2,19 @@ package cli
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 
-	"github.com/golang/glog"
 	cli "github.com/jawher/mow.cli"
+	"github.com/nmaupu/freenas-provisioner/logging"
 	freenasProvisioner "github.com/nmaupu/freenas-provisioner/provisioner"
+	"github.com/nmaupu/freenas-provisioner/tracing"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 )
 
@@ -25,13 +27,28 @@ var (
 	kubeconfig      *string
 	identifier      *string
 	provisionerName *string
+	shareConsumers  *bool
+	namespaceQuota  *bool
+	namespaceClean  *bool
+
+	capacityInterval  *string
+	capacityNamespace *string
+	usageInterval     *string
+	snapshotInterval  *string
+	unlockInterval    *string
+	metricsPort       *int
+	healthPort        *int
+	dryRun            *bool
+	logFormat         *string
+	logLevel          *string
+
+	// flushes the spans not exported yet
+	shutdownTracing func(context.Context) error
 )
 
 // Process all command line parameters
 func Process(appName, appDesc, appVersion string) {
 	syscall.Umask(0)
-	flag.Set("logtostderr", "true")
-	flag.CommandLine.Parse([]string{})
 
 	app := cli.App(appName, appDesc)
 	app.Version("v version", fmt.Sprintf("%s version %s", appName, appVersion))
@@ -54,19 +71,207 @@ func Process(appName, appDesc, appVersion string) {
 		EnvVar: "PROVISIONER_NAME",
 	})
 
+	logFormat = app.String(cli.StringOpt{
+		Name:   "log-format",
+		Value:  "text",
+		Desc:   "Format of the logs (json or text)",
+		EnvVar: "LOG_FORMAT",
+	})
+	logLevel = app.String(cli.StringOpt{
+		Name:   "log-level",
+		Value:  "info",
+		Desc:   "Level of the logs (info or debug, debug logs FreeNAS API requests and their redacted bodies)",
+		EnvVar: "LOG_LEVEL",
+	})
+
+	dryRun = app.Bool(cli.BoolOpt{
+		Name:   "dry-run",
+		Value:  false,
+		Desc:   "Log and record as events the changes on FreeNAS instead of applying them, provisioning and deletion then fail",
+		EnvVar: "DRY_RUN",
+	})
+
+	shareConsumers = app.Bool(cli.BoolOpt{
+		Name:   "share-consumers-controller",
+		Value:  false,
+		Desc:   "Restrict NFS shares of classes using shareHostsFromConsumers to the nodes consuming them",
+		EnvVar: "SHARE_CONSUMERS_CONTROLLER",
+	})
+
+	namespaceQuota = app.Bool(cli.BoolOpt{
+		Name:   "namespace-quota-controller",
+		Value:  false,
+		Desc:   "Keep namespace datasets quota in sync with the namespace ResourceQuotas storage requests",
+		EnvVar: "NAMESPACE_QUOTA_CONTROLLER",
+	})
+
+	namespaceClean = app.Bool(cli.BoolOpt{
+		Name:   "namespace-cleanup-controller",
+		Value:  false,
+		Desc:   "Delete empty namespace datasets when their namespace is deleted (StorageClasses with datasetRetainNamespaces disabled only)",
+		EnvVar: "NAMESPACE_CLEANUP_CONTROLLER",
+	})
+
+	capacityInterval = app.String(cli.StringOpt{
+		Name:   "capacity-interval",
+		Value:  "",
+		Desc:   "Interval between publications of CSIStorageCapacity objects (e.g. 1m), disabled if empty",
+		EnvVar: "CAPACITY_INTERVAL",
+	})
+	capacityNamespace = app.String(cli.StringOpt{
+		Name:   "capacity-namespace",
+		Value:  "kube-system",
+		Desc:   "Namespace where CSIStorageCapacity objects are published",
+		EnvVar: "POD_NAMESPACE",
+	})
+
+	usageInterval = app.String(cli.StringOpt{
+		Name:   "usage-interval",
+		Value:  "",
+		Desc:   "Interval between reports of volumes usage (e.g. 5m), disabled if empty",
+		EnvVar: "USAGE_INTERVAL",
+	})
+	snapshotInterval = app.String(cli.StringOpt{
+		Name:   "snapshot-prune-interval",
+		Value:  "",
+		Desc:   "Interval between prunings of snapshots whose retention is a count (e.g. 10m), disabled if empty",
+		EnvVar: "SNAPSHOT_PRUNE_INTERVAL",
+	})
+	unlockInterval = app.String(cli.StringOpt{
+		Name:   "unlock-interval",
+		Value:  "",
+		Desc:   "Interval between checks of encrypted datasets to unlock (e.g. 1m), disabled if empty",
+		EnvVar: "UNLOCK_INTERVAL",
+	})
+	metricsPort = app.Int(cli.IntOpt{
+		Name:   "metrics-port",
+		Value:  0,
+		Desc:   "Port of the Prometheus metrics endpoint (/metrics), disabled if 0",
+		EnvVar: "METRICS_PORT",
+	})
+
+	healthPort = app.Int(cli.IntOpt{
+		Name:   "health-port",
+		Value:  0,
+		Desc:   "Port of the /healthz, /readyz and /debug/backends endpoints, disabled if 0",
+		EnvVar: "HEALTH_PORT",
+	})
+
+	app.Command("doctor", "Check a StorageClass end to end against its FreeNAS server", doctorCmd)
+	app.Command("export", "Export the inventory of the volumes of the provisioner", exportCmd)
+	app.Command("restore", "Recreate the volumes of an inventory whose dataset and share still exist", restoreCmd)
+
+	app.Before = func() {
+		setupLogging()
+		setupTracing(appName, appVersion)
+	}
+	app.After = func() {
+		shutdownTracing(context.Background())
+	}
 	app.Action = execute
 	app.Run(os.Args)
 }
 
-func execute() {
+// setupLogging sets up the root logger from the log format and level parameters
+func setupLogging() {
+	err := logging.Setup(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		cli.Exit(1)
+	}
+}
+
+// setupTracing exports spans if an OTLP endpoint is set in the OTEL_* environment variables
+func setupTracing(appName, appVersion string) {
+	var err error
+	shutdownTracing, err = tracing.Setup(context.Background(), appName, appVersion)
+	if err != nil {
+		logging.Log.Error(err, "Cannot setup tracing")
+		cli.Exit(1)
+	}
+}
+
+// newClientset returns a kubernetes client using kubeconfig if set, in cluster config otherwise
+func newClientset() *kubernetes.Clientset {
 	var err error
 	var config *rest.Config
 
+	if *kubeconfig != "" {
+		// use the current context in kubeconfig
+		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		// Create an InClusterConfig and use it to create a client for the controller
+		// to use to communicate with Kubernetes
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		logging.Log.Error(err, "Failed to create config")
+		os.Exit(1)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logging.Log.Error(err, "Failed to create client")
+		os.Exit(1)
+	}
+
+	return clientset
+}
+
+func execute() {
+	var err error
+
 	/* Params checking */
 	var msgs []string
 	if *identifier == "" {
 		msgs = append(msgs, "Identifier parameter must be specified")
 	}
+	var capacityPublisherInterval time.Duration
+	if *capacityInterval != "" {
+		capacityPublisherInterval, err = time.ParseDuration(*capacityInterval)
+		if err != nil || capacityPublisherInterval <= 0 {
+			msgs = append(msgs, fmt.Sprintf("Invalid capacity interval \"%s\"", *capacityInterval))
+		}
+	}
+	var usagePollerInterval time.Duration
+	if *usageInterval != "" {
+		usagePollerInterval, err = time.ParseDuration(*usageInterval)
+		if err != nil || usagePollerInterval <= 0 {
+			msgs = append(msgs, fmt.Sprintf("Invalid usage interval \"%s\"", *usageInterval))
+		}
+	}
+	var snapshotPrunerInterval time.Duration
+	if *snapshotInterval != "" {
+		snapshotPrunerInterval, err = time.ParseDuration(*snapshotInterval)
+		if err != nil || snapshotPrunerInterval <= 0 {
+			msgs = append(msgs, fmt.Sprintf("Invalid snapshot prune interval \"%s\"", *snapshotInterval))
+		}
+	}
+	var datasetUnlockerInterval time.Duration
+	if *unlockInterval != "" {
+		datasetUnlockerInterval, err = time.ParseDuration(*unlockInterval)
+		if err != nil || datasetUnlockerInterval <= 0 {
+			msgs = append(msgs, fmt.Sprintf("Invalid unlock interval \"%s\"", *unlockInterval))
+		}
+	}
+
+	// background controllers change FreeNAS and have no dry run mode
+	if *dryRun {
+		for _, background := range []struct {
+			flag    string
+			enabled bool
+		}{
+			{"--share-consumers-controller", *shareConsumers},
+			{"--namespace-quota-controller", *namespaceQuota},
+			{"--namespace-cleanup-controller", *namespaceClean},
+			{"--snapshot-prune-interval", snapshotPrunerInterval > 0},
+			{"--unlock-interval", datasetUnlockerInterval > 0},
+		} {
+			if background.enabled {
+				msgs = append(msgs, fmt.Sprintf("%s cannot be used along with --dry-run, it changes FreeNAS", background.flag))
+			}
+		}
+	}
 
 	// Print all parameters' error and exist if need be
 	if len(msgs) > 0 {
@@ -78,33 +283,26 @@ func execute() {
 	}
 	/* End params checking */
 
-	if *kubeconfig != "" {
-		// use the current context in kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	} else {
-		// Create an InClusterConfig and use it to create a client for the controller
-		// to use to communicate with Kubernetes
-		config, err = rest.InClusterConfig()
-	}
-	if err != nil {
-		glog.Fatalf("Failed to create config: %v", err)
-	}
-
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		glog.Fatalf("Failed to create client: %v", err)
-	}
+	clientset := newClientset()
 
 	// The controller needs to know what the server version is because out-of-tree
 	// provisioners aren't officially supported until 1.5
 	serverVersion, err := clientset.Discovery().ServerVersion()
 	if err != nil {
-		glog.Fatalf("Error getting server version: %v", err)
+		logging.Log.Error(err, "Error getting server version")
+		os.Exit(1)
 	}
 
+	// a single recorder for the provisioner and every controller
+	recorder, stopRecording := freenasProvisioner.NewEventRecorder(clientset, *identifier)
+	defer stopRecording()
+
 	clientFreenasProvisioner := freenasProvisioner.New(
 		clientset,
 		*identifier,
+		recorder,
+		*dryRun,
+		snapshotPrunerInterval > 0,
 	)
 
 	// Start the provision controller which will dynamically provision datasets and nfs shares
@@ -114,6 +312,54 @@ func execute() {
 		clientFreenasProvisioner,
 		serverVersion.GitVersion,
 		controller.ExponentialBackOffOnError(exponentialBackOffOnError),
+		controller.MetricsPort(int32(*metricsPort)),
+		// leader election is done below so the background controllers only run on the leader too
+		controller.LeaderElection(false),
 	)
-	pc.Run(context.Background())
+	ctx := context.Background()
+
+	// liveness follows the lease renewals of the leader election loop
+	watchdog := leaderelection.NewLeaderHealthzAdaptor(leaderElectionHealthzTimeout)
+	if *healthPort > 0 {
+		go freenasProvisioner.NewHealthServer(clientset, *identifier, recorder, *provisionerName, *healthPort, watchdog).Run(ctx)
+	}
+
+	runLeaderElected(ctx, clientset, recorder, *provisionerName, watchdog, func(ctx context.Context) {
+		go freenasProvisioner.CheckNfsServices(ctx, clientset, *identifier, recorder, *provisionerName)
+
+		// key Secrets of encrypted volumes are owned by their PV once it is created
+		if !*dryRun {
+			go freenasProvisioner.NewEncryptionKeyOwnerController(clientset, *identifier, recorder).Run(ctx)
+		}
+
+		if *shareConsumers {
+			go freenasProvisioner.NewShareConsumersController(clientset, *identifier, recorder).Run(ctx)
+		}
+
+		if *namespaceQuota {
+			go freenasProvisioner.NewNamespaceQuotaController(clientset, *identifier, recorder, *provisionerName).Run(ctx)
+		}
+
+		if *namespaceClean {
+			go freenasProvisioner.NewNamespaceCleanupController(clientset, *identifier, recorder, *provisionerName).Run(ctx)
+		}
+
+		if usagePollerInterval > 0 {
+			go freenasProvisioner.NewUsagePoller(clientset, *identifier, recorder, usagePollerInterval).Run(ctx)
+		}
+
+		if snapshotPrunerInterval > 0 {
+			go freenasProvisioner.NewSnapshotPruner(clientset, *identifier, recorder, snapshotPrunerInterval).Run(ctx)
+		}
+
+		if datasetUnlockerInterval > 0 {
+			go freenasProvisioner.NewDatasetUnlocker(clientset, *identifier, recorder, datasetUnlockerInterval).Run(ctx)
+		}
+
+		if capacityPublisherInterval > 0 {
+			go freenasProvisioner.NewCapacityPublisher(clientset, *identifier, recorder, *provisionerName, *capacityNamespace, capacityPublisherInterval).Run(ctx)
+		}
+
+		pc.Run(ctx)
+	})
 }
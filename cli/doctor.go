@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"context"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	freenasProvisioner "github.com/nmaupu/freenas-provisioner/provisioner"
+)
+
+func doctorCmd(cmd *cli.Cmd) {
+	cmd.Spec = "[--backend] CLASS"
+
+	class := cmd.StringArg("CLASS", "", "StorageClass to check")
+	backend := cmd.StringOpt("b backend", "", "Secret of the backend to check (defaults to the first one of the class)")
+
+	cmd.Action = func() {
+		clientset := newClientset()
+		recorder, stopRecording := freenasProvisioner.NewEventRecorder(clientset, *identifier)
+		ok := freenasProvisioner.Doctor(context.Background(), clientset, *identifier, recorder, *class, *backend, os.Stdout)
+		stopRecording()
+		if !ok {
+			cli.Exit(1)
+		}
+	}
+}
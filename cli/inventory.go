@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	freenasProvisioner "github.com/nmaupu/freenas-provisioner/provisioner"
+	"sigs.k8s.io/yaml"
+)
+
+func exportCmd(cmd *cli.Cmd) {
+	cmd.Spec = "[--format] [--output]"
+
+	format := cmd.StringOpt("f format", "yaml", "Format of the inventory (json or yaml)")
+	output := cmd.StringOpt("o output", "", "File to write the inventory to (defaults to stdout)")
+
+	cmd.Action = func() {
+		inventory, err := freenasProvisioner.ExportInventory(context.Background(), newClientset(), *identifier)
+		if err != nil {
+			logging.Log.Error(err, "Cannot export inventory")
+			cli.Exit(1)
+		}
+
+		var b []byte
+		switch *format {
+		case "json":
+			b, err = json.MarshalIndent(inventory, "", "  ")
+			b = append(b, '\n')
+		case "yaml":
+			b, err = yaml.Marshal(inventory)
+		default:
+			err = fmt.Errorf("Invalid format \"%s\", must be json or yaml", *format)
+		}
+		if err != nil {
+			logging.Log.Error(err, "Cannot export inventory")
+			cli.Exit(1)
+		}
+
+		if *output == "" {
+			_, err = os.Stdout.Write(b)
+		} else {
+			err = ioutil.WriteFile(*output, b, 0600)
+		}
+		if err != nil {
+			logging.Log.Error(err, "Cannot write inventory")
+			cli.Exit(1)
+		}
+	}
+}
+
+func restoreCmd(cmd *cli.Cmd) {
+	cmd.Spec = "[--claims] FILE"
+
+	file := cmd.StringArg("FILE", "", "Inventory to restore (json or yaml)")
+	claims := cmd.BoolOpt("c claims", false, "Also recreate the PersistentVolumeClaims the volumes were bound to")
+
+	cmd.Action = func() {
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			logging.Log.Error(err, "Cannot read inventory")
+			cli.Exit(1)
+		}
+
+		// json being yaml, both formats are read
+		inventory := freenasProvisioner.Inventory{}
+		err = yaml.Unmarshal(b, &inventory)
+		if err != nil {
+			logging.Log.Error(err, "Cannot read inventory", "file", *file)
+			cli.Exit(1)
+		}
+
+		clientset := newClientset()
+		recorder, stopRecording := freenasProvisioner.NewEventRecorder(clientset, *identifier)
+		ok := freenasProvisioner.RestoreInventory(context.Background(), clientset, *identifier, recorder, &inventory, *claims, os.Stdout)
+		stopRecording()
+		if !ok {
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// leaderElectionHealthzTimeout is how late the lease renewal may be before the leader is reported unhealthy
+const leaderElectionHealthzTimeout = 20 * time.Second
+
+// runLeaderElected calls run once this replica holds the lease and exits when it loses it.
+// The lock is the one the provision controller takes on its own, so replicas
+// running an older release still exclude each other
+func runLeaderElected(ctx context.Context, clientset kubernetes.Interface, recorder record.EventRecorder, provisionerName string, watchdog *leaderelection.HealthzAdaptor, run func(ctx context.Context)) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logging.Log.Error(err, "Error getting hostname")
+		os.Exit(1)
+	}
+
+	lock, err := resourcelock.New(
+		"endpoints",
+		leaderElectionNamespace(),
+		strings.Replace(provisionerName, "/", "-", -1),
+		clientset.CoreV1(),
+		nil,
+		resourcelock.ResourceLockConfig{
+			Identity:      hostname + "_" + string(uuid.NewUUID()),
+			EventRecorder: recorder,
+		},
+	)
+	if err != nil {
+		logging.Log.Error(err, "Error creating leader election lock")
+		os.Exit(1)
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: controller.DefaultLeaseDuration,
+		RenewDeadline: controller.DefaultRenewDeadline,
+		RetryPeriod:   controller.DefaultRetryPeriod,
+		WatchDog:      watchdog,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				logging.Log.Info("Leader election lost, exiting")
+				os.Exit(1)
+			},
+		},
+	})
+}
+
+// leaderElectionNamespace mirrors the namespace the provision controller picks for its lock
+func leaderElectionNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
+		}
+	}
+
+	return "default"
+}
@@ -0,0 +1,237 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	_ FreenasResource = &User{}
+	_ FreenasResource = &Group{}
+)
+
+type User struct {
+	Id               int    `json:"id,omitempty"`
+	Uid              int    `json:"bsdusr_uid,omitempty"`
+	Username         string `json:"bsdusr_username"`
+	FullName         string `json:"bsdusr_full_name,omitempty"`
+	Group            int    `json:"bsdusr_group,omitempty"`
+	CreateGroup      bool   `json:"bsdusr_creategroup,omitempty"`
+	PasswordDisabled bool   `json:"bsdusr_password_disabled,omitempty"`
+	Builtin          bool   `json:"bsdusr_builtin,omitempty"`
+}
+
+func (u *User) CopyFrom(source FreenasResource) error {
+	src, ok := source.(*User)
+	if ok {
+		u.Id = src.Id
+		u.Uid = src.Uid
+		u.Username = src.Username
+		u.FullName = src.FullName
+		u.Group = src.Group
+		u.PasswordDisabled = src.PasswordDisabled
+		u.Builtin = src.Builtin
+	}
+
+	return errors.New("Cannot copy, src is not a User")
+}
+
+// Get a user by id, or by name (or uid if no name is set) otherwise
+func (u *User) Get(server *FreenasServer) error {
+	if u.Id > 0 {
+		endpoint := fmt.Sprintf("/api/v1.0/account/users/%d/", u.Id)
+		var user User
+		var e interface{}
+		resp, err := server.getSlingConnection().Get(endpoint).Receive(&user, &e)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			body, _ := json.Marshal(e)
+			return errors.New(fmt.Sprintf("Error getting user \"%d\" - message: %v, status: %d", u.Id, string(body), resp.StatusCode))
+		}
+
+		u.CopyFrom(&user)
+
+		return nil
+	}
+
+	users, err := ListUsers(server)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if (u.Username != "" && user.Username == u.Username) || (u.Username == "" && user.Uid == u.Uid) {
+			u.CopyFrom(&user)
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("User \"%s\" (uid: %d) has not been found", u.Username, u.Uid))
+}
+
+// ListUsers returns every user of the server, page by page
+func ListUsers(server *FreenasServer) ([]User, error) {
+	var users []User
+	err := listPages(server, "/api/v1.0/account/users/", "users", func(data json.RawMessage) (int, error) {
+		var page []User
+		err := json.Unmarshal(data, &page)
+		users = append(users, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (u *User) Create(server *FreenasServer) error {
+	endpoint := "/api/v1.0/account/users/"
+	var user User
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(endpoint).BodyJSON(u).Receive(&user, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating user \"%s\" - message: %v, status: %d", u.Username, string(body), resp.StatusCode))
+	}
+
+	u.CopyFrom(&user)
+
+	return nil
+}
+
+func (u *User) Delete(server *FreenasServer) error {
+	endpoint := fmt.Sprintf("/api/v1.0/account/users/%d/", u.Id)
+	var e interface{}
+	resp, err := server.getSlingConnection().Delete(endpoint).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error deleting user \"%s\" - %v", u.Username, string(body)))
+	}
+
+	return nil
+}
+
+type Group struct {
+	Id      int    `json:"id,omitempty"`
+	Gid     int    `json:"bsdgrp_gid,omitempty"`
+	Name    string `json:"bsdgrp_group"`
+	Builtin bool   `json:"bsdgrp_builtin,omitempty"`
+}
+
+func (g *Group) CopyFrom(source FreenasResource) error {
+	src, ok := source.(*Group)
+	if ok {
+		g.Id = src.Id
+		g.Gid = src.Gid
+		g.Name = src.Name
+		g.Builtin = src.Builtin
+	}
+
+	return errors.New("Cannot copy, src is not a Group")
+}
+
+// Get a group by id, or by name (or gid if no name is set) otherwise
+func (g *Group) Get(server *FreenasServer) error {
+	if g.Id > 0 {
+		endpoint := fmt.Sprintf("/api/v1.0/account/groups/%d/", g.Id)
+		var group Group
+		var e interface{}
+		resp, err := server.getSlingConnection().Get(endpoint).Receive(&group, &e)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			body, _ := json.Marshal(e)
+			return errors.New(fmt.Sprintf("Error getting group \"%d\" - message: %v, status: %d", g.Id, string(body), resp.StatusCode))
+		}
+
+		g.CopyFrom(&group)
+
+		return nil
+	}
+
+	groups, err := ListGroups(server)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if (g.Name != "" && group.Name == g.Name) || (g.Name == "" && group.Gid == g.Gid) {
+			g.CopyFrom(&group)
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Group \"%s\" (gid: %d) has not been found", g.Name, g.Gid))
+}
+
+// ListGroups returns every group of the server, page by page
+func ListGroups(server *FreenasServer) ([]Group, error) {
+	var groups []Group
+	err := listPages(server, "/api/v1.0/account/groups/", "groups", func(data json.RawMessage) (int, error) {
+		var page []Group
+		err := json.Unmarshal(data, &page)
+		groups = append(groups, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func (g *Group) Create(server *FreenasServer) error {
+	endpoint := "/api/v1.0/account/groups/"
+	var group Group
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(endpoint).BodyJSON(g).Receive(&group, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating group \"%s\" - message: %v, status: %d", g.Name, string(body), resp.StatusCode))
+	}
+
+	g.CopyFrom(&group)
+
+	return nil
+}
+
+func (g *Group) Delete(server *FreenasServer) error {
+	endpoint := fmt.Sprintf("/api/v1.0/account/groups/%d/", g.Id)
+	var e interface{}
+	resp, err := server.getSlingConnection().Delete(endpoint).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error deleting group \"%s\" - %v", g.Name, string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	aclBasicPermissions = []string{"FULL_CONTROL", "MODIFY", "READ", "TRAVERSE"}
+	aclBasicFlags       = []string{"INHERIT", "NOINHERIT"}
+)
+
+// AccessControlEntry is a NFSv4 ACE
+//   - Principal: owner@, group@, everyone@, user:<name|uid> or group:<name|gid>
+//   - Type: ALLOW or DENY
+//   - Permissions: a basic permission (FULL_CONTROL, MODIFY, READ, TRAVERSE)
+//     or a list of advanced ones (READ_DATA, WRITE_DATA, EXECUTE, ...)
+//   - Inheritance: a basic flag (INHERIT, NOINHERIT) or a list of advanced ones
+//     (FILE_INHERIT, DIRECTORY_INHERIT, NO_PROPAGATE_INHERIT, INHERIT_ONLY)
+type AccessControlEntry struct {
+	Principal   string   `json:"principal"`
+	Type        string   `json:"type"`
+	Permissions []string `json:"permissions"`
+	Inheritance []string `json:"inheritance,omitempty"`
+}
+
+// Validate checks the ACE can be sent to the API
+func (a *AccessControlEntry) Validate() error {
+	if _, _, _, err := a.principal(); err != nil {
+		return err
+	}
+
+	if a.Type != "ALLOW" && a.Type != "DENY" {
+		return fmt.Errorf("Invalid ACE type \"%s\" for principal \"%s\", must be ALLOW or DENY", a.Type, a.Principal)
+	}
+
+	if len(a.Permissions) == 0 {
+		return fmt.Errorf("No permissions for ACE of principal \"%s\"", a.Principal)
+	}
+
+	return nil
+}
+
+// principal returns the API tag, id and name of the principal
+func (a *AccessControlEntry) principal() (string, int, string, error) {
+	switch a.Principal {
+	case "owner@", "group@", "everyone@":
+		return a.Principal, -1, "", nil
+	}
+
+	kv := strings.SplitN(a.Principal, ":", 2)
+	if len(kv) != 2 || kv[1] == "" || (kv[0] != "user" && kv[0] != "group") {
+		return "", 0, "", fmt.Errorf("Invalid ACE principal \"%s\", must be owner@, group@, everyone@, user:<name|uid> or group:<name|gid>", a.Principal)
+	}
+
+	tag := strings.ToUpper(kv[0])
+	if id, err := strconv.Atoi(kv[1]); err == nil {
+		return tag, id, "", nil
+	}
+
+	return tag, -1, kv[1], nil
+}
+
+func (a *AccessControlEntry) MarshalJSON() ([]byte, error) {
+	tag, id, who, err := a.principal()
+	if err != nil {
+		return nil, err
+	}
+
+	data := &struct {
+		Tag   string                 `json:"tag"`
+		Id    int                    `json:"id"`
+		Who   string                 `json:"who,omitempty"`
+		Type  string                 `json:"type"`
+		Perms map[string]interface{} `json:"perms"`
+		Flags map[string]interface{} `json:"flags"`
+	}{
+		Tag:   tag,
+		Id:    id,
+		Who:   who,
+		Type:  a.Type,
+		Perms: aclBitmap(a.Permissions, aclBasicPermissions),
+		Flags: aclBitmap(a.Inheritance, aclBasicFlags),
+	}
+
+	return json.Marshal(data)
+}
+
+// aclBitmap returns the basic form of a single basic value, or the advanced form otherwise
+func aclBitmap(values []string, basics []string) map[string]interface{} {
+	bitmap := map[string]interface{}{}
+	if len(values) == 1 {
+		for _, basic := range basics {
+			if values[0] == basic {
+				bitmap["BASIC"] = basic
+				return bitmap
+			}
+		}
+	}
+
+	for _, v := range values {
+		bitmap[v] = true
+	}
+
+	return bitmap
+}
+
+// Acl is a NFSv4 ACL set on a path
+type Acl struct {
+	Path      string               `json:"path"`
+	Dacl      []AccessControlEntry `json:"dacl"`
+	Recursive bool                 `json:"-"`
+}
+
+func (a *Acl) MarshalJSON() ([]byte, error) {
+	data := &struct {
+		Path    string               `json:"path"`
+		Dacl    []AccessControlEntry `json:"dacl"`
+		Acltype string               `json:"acltype"`
+		Options map[string]bool      `json:"options"`
+	}{
+		Path:    a.Path,
+		Dacl:    a.Dacl,
+		Acltype: "NFS4",
+		Options: map[string]bool{
+			"recursive": a.Recursive,
+			"traverse":  false,
+		},
+	}
+
+	return json.Marshal(data)
+}
+
+// PutRequest returns the request setting the ACL
+func (a *Acl) PutRequest() Request {
+	return Request{Method: "POST", Endpoint: "/api/v2.0/filesystem/setacl", Body: a}
+}
+
+func (a *Acl) Put(server *FreenasServer) error {
+	request := a.PutRequest()
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error setting ACL on \"%s\" - message: %v, status: %d", a.Path, string(body), resp.StatusCode))
+	}
+
+	return nil
+}
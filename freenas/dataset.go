@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang/glog"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -26,6 +26,9 @@ type Dataset struct {
 	Refer          int64  `json:"refer,omitempty"`
 	Used           int64  `json:"used,omitempty"`
 	Comments       string `json:"comments,omitempty"`
+
+	// Encryption options, only used on creation
+	Encryption *DatasetEncryption `json:"-"`
 }
 
 func (d *Dataset) MarshalJSON() ([]byte, error) {
@@ -102,7 +105,6 @@ func (d *Dataset) Get(server *FreenasServer) error {
 	var e interface{}
 	resp, err := server.getSlingConnection().Get(endpoint).Receive(&dataset, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -117,29 +119,111 @@ func (d *Dataset) Get(server *FreenasServer) error {
 	return nil
 }
 
-func (d *Dataset) Create(server *FreenasServer) error {
+// ListDatasets returns all the datasets (including the pools' root datasets)
+func ListDatasets(server *FreenasServer) ([]Dataset, error) {
+	var datasets []Dataset
+	err := listPages(server, "/api/v1.0/storage/dataset/", "datasets", func(data json.RawMessage) (int, error) {
+		var page []Dataset
+		err := json.Unmarshal(data, &page)
+		datasets = append(datasets, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return datasets, nil
+}
+
+// Children returns the descendant datasets
+func (d *Dataset) Children(server *FreenasServer) ([]Dataset, error) {
+	datasets, err := ListDatasets(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []Dataset
+	for _, dataset := range datasets {
+		if strings.HasPrefix(dataset.Name, d.Name+"/") {
+			children = append(children, dataset)
+		}
+	}
+
+	return children, nil
+}
+
+// CreateRequest returns the request creating the dataset, with the v2 API if it is encrypted
+func (d *Dataset) CreateRequest() Request {
+	if d.Encryption != nil {
+		return d.createEncryptedRequest()
+	}
+
+	// the v1 API expects the parent in the endpoint and the last component as name
 	parent, dsName := filepath.Split(d.Name)
-	endpoint := fmt.Sprintf("/api/v1.0/storage/dataset/%s", parent)
+	body := *d
+	body.Name = dsName
+	return Request{Method: "POST", Endpoint: fmt.Sprintf("/api/v1.0/storage/dataset/%s", parent), Body: &body}
+}
+
+func (d *Dataset) Create(server *FreenasServer) error {
+	if d.Encryption != nil {
+		return d.createEncrypted(server)
+	}
+
+	request := d.CreateRequest()
 	var dataset Dataset
 	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(&dataset, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-	// rewrite Name attribute to support crazy api semantics
-	d.Name = dsName
+	if resp.StatusCode != 201 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
+	}
 
-	resp, err := server.getSlingConnection().Post(endpoint).BodyJSON(d).Receive(&dataset, &e)
+	d.CopyFrom(&dataset)
 
-	// rewrite Name attribute to support crazy api semantics
-	d.Name = filepath.Join(parent, dsName)
+	return nil
+}
 
+// UpdateRequest returns the request setting the quotas, reservations and comments of the dataset
+func (d *Dataset) UpdateRequest() Request {
+	return Request{
+		Method:   "PUT",
+		Endpoint: fmt.Sprintf("/api/v1.0/storage/dataset/%s/", d.Name),
+		Body: &struct {
+			Quota          string `json:"quota"`
+			Reservation    string `json:"reservation"`
+			Refquota       string `json:"refquota"`
+			Refreservation string `json:"refreservation"`
+			Comments       string `json:"comments"`
+		}{
+			Quota:          strconv.FormatInt(d.Quota, 10) + "b",
+			Reservation:    strconv.FormatInt(d.Reservation, 10) + "b",
+			Refquota:       strconv.FormatInt(d.Refquota, 10) + "b",
+			Refreservation: strconv.FormatInt(d.Refreservation, 10) + "b",
+			Comments:       d.Comments,
+		},
+	}
+}
+
+// Update sets the quotas, reservations and comments of an existing dataset
+func (d *Dataset) Update(server *FreenasServer) error {
+	request := d.UpdateRequest()
+	var dataset Dataset
+	var e interface{}
+	resp, err := server.getSlingConnection().Put(request.Endpoint).BodyJSON(request.Body).Receive(&dataset, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
+	if resp.StatusCode != 200 {
 		body, _ := json.Marshal(e)
-		return errors.New(fmt.Sprintf("Error creating dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
+		return errors.New(fmt.Sprintf("Error updating dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
 	}
 
 	d.CopyFrom(&dataset)
@@ -147,12 +231,16 @@ func (d *Dataset) Create(server *FreenasServer) error {
 	return nil
 }
 
+// DeleteRequest returns the request deleting the dataset
+func (d *Dataset) DeleteRequest() Request {
+	return Request{Method: "DELETE", Endpoint: fmt.Sprintf("/api/v1.0/storage/dataset/%s/", d.Name)}
+}
+
 func (d *Dataset) Delete(server *FreenasServer) error {
-	endpoint := fmt.Sprintf("/api/v1.0/storage/dataset/%s/", d.Name)
+	request := d.DeleteRequest()
 	var e interface{}
-	resp, err := server.getSlingConnection().Delete(endpoint).Receive(nil, &e)
+	resp, err := server.getSlingConnection().Delete(request.Endpoint).Receive(nil, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
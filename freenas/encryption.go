@@ -0,0 +1,134 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var (
+	EncryptionAlgorithms = []string{"AES-128-CCM", "AES-192-CCM", "AES-256-CCM", "AES-128-GCM", "AES-192-GCM", "AES-256-GCM"}
+)
+
+// DatasetEncryption holds the native ZFS encryption options of a dataset
+// either Passphrase or Key (64 hexadecimal characters) is set
+type DatasetEncryption struct {
+	Algorithm  string `json:"algorithm,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Key        string `json:"key,omitempty"`
+}
+
+// createEncryptedRequest returns the request creating an encrypted dataset, only available with the v2 API
+func (d *Dataset) createEncryptedRequest() Request {
+	data := &struct {
+		Name              string             `json:"name"`
+		Type              string             `json:"type"`
+		Quota             int64              `json:"quota,omitempty"`
+		Reservation       int64              `json:"reservation,omitempty"`
+		Refquota          int64              `json:"refquota,omitempty"`
+		Refreservation    int64              `json:"refreservation,omitempty"`
+		Comments          string             `json:"comments,omitempty"`
+		InheritEncryption bool               `json:"inherit_encryption"`
+		Encryption        bool               `json:"encryption"`
+		EncryptionOptions *DatasetEncryption `json:"encryption_options"`
+	}{
+		Name:              d.Name,
+		Type:              "FILESYSTEM",
+		Quota:             d.Quota,
+		Reservation:       d.Reservation,
+		Refquota:          d.Refquota,
+		Refreservation:    d.Refreservation,
+		Comments:          d.Comments,
+		InheritEncryption: false,
+		Encryption:        true,
+		EncryptionOptions: d.Encryption,
+	}
+
+	return Request{Method: "POST", Endpoint: "/api/v2.0/pool/dataset", Body: data}
+}
+
+// createEncrypted creates an encrypted dataset
+func (d *Dataset) createEncrypted(server *FreenasServer) error {
+	request := d.createEncryptedRequest()
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating encrypted dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
+	}
+
+	// refresh mountpoint and properties
+	return d.Get(server)
+}
+
+// Locked returns whether the dataset is encrypted and its key is not loaded
+func (d *Dataset) Locked(server *FreenasServer) (bool, error) {
+	endpoint := "/api/v2.0/pool/dataset/id/" + url.PathEscape(d.Name)
+	var dataset struct {
+		Encrypted bool `json:"encrypted"`
+		Locked    bool `json:"locked"`
+	}
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&dataset, &e)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return false, errors.New(fmt.Sprintf("Error getting encryption of dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
+	}
+
+	return dataset.Encrypted && dataset.Locked, nil
+}
+
+// UnlockRequest returns the request loading the key of an encrypted dataset
+func (d *Dataset) UnlockRequest(encryption *DatasetEncryption) Request {
+	type unlockDataset struct {
+		Name       string `json:"name"`
+		Passphrase string `json:"passphrase,omitempty"`
+		Key        string `json:"key,omitempty"`
+	}
+	data := &struct {
+		Id            string `json:"id"`
+		UnlockOptions struct {
+			Recursive bool            `json:"recursive"`
+			Datasets  []unlockDataset `json:"datasets"`
+		} `json:"unlock_options"`
+	}{
+		Id: d.Name,
+	}
+	data.UnlockOptions.Datasets = []unlockDataset{{
+		Name:       d.Name,
+		Passphrase: encryption.Passphrase,
+		Key:        encryption.Key,
+	}}
+
+	return Request{Method: "POST", Endpoint: "/api/v2.0/pool/dataset/unlock", Body: data}
+}
+
+// Unlock loads the key of an encrypted dataset, the returned id is the one of the unlock job
+func (d *Dataset) Unlock(server *FreenasServer, encryption *DatasetEncryption) (int, error) {
+	request := d.UnlockRequest(encryption)
+	var job int
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(&job, &e)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return 0, errors.New(fmt.Sprintf("Error unlocking dataset \"%s\" - message: %v, status: %d", d.Name, string(body), resp.StatusCode))
+	}
+
+	return job, nil
+}
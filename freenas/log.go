@@ -0,0 +1,129 @@
+package freenas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"github.com/nmaupu/freenas-provisioner/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// values of matching keys are redacted from logged bodies
+	sensitiveKeys = regexp.MustCompile(`(?i)pass|secret|key|token`)
+	// resource of an endpoint (ie: /api/v1.0/storage/dataset of /api/v1.0/storage/dataset/tank/pv/), used in span names
+	endpointResource = regexp.MustCompile(`^/api/[^/]+/[^/]+(/[^/0-9][^/]*)?`)
+)
+
+// WithLogger returns a copy of the server logging with log and sending requestId
+// along with its requests (X-Request-Id header)
+func (s *FreenasServer) WithLogger(log logr.Logger, requestId string) *FreenasServer {
+	server := *s
+	server.Log = log.WithValues("host", s.Host)
+	server.RequestId = requestId
+	return &server
+}
+
+// loggingDoer logs the requests sent to the API, and their bodies at debug level
+// and traces them as children of the span of ctx
+type loggingDoer struct {
+	client    *http.Client
+	log       logr.Logger
+	requestId string
+	ctx       context.Context
+}
+
+func (d *loggingDoer) Do(req *http.Request) (resp *http.Response, err error) {
+	endpoint := req.URL.RequestURI()
+	ctx, span := tracing.Start(d.ctx, "FreeNAS "+req.Method+" "+endpointResource.FindString(req.URL.Path), trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPMethodKey.String(req.Method),
+		attribute.String("freenas.endpoint", endpoint),
+		attribute.String("freenas.host", req.URL.Host),
+	))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+			if resp.StatusCode >= 400 && err == nil {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+		}
+		tracing.End(span, err)
+	}()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	log := d.log.WithValues("method", req.Method, "endpoint", endpoint)
+	if d.requestId != "" {
+		req.Header.Set("X-Request-Id", d.requestId)
+	}
+
+	debug := log.V(logging.BodyVerbosity).Enabled()
+	if debug && req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		log.V(logging.BodyVerbosity).Info("FreeNAS request body", "body", redact(body))
+	}
+
+	start := time.Now()
+	resp, err = d.client.Do(req)
+	if err != nil {
+		log.Error(err, "FreeNAS request failed", "duration", time.Since(start).String())
+		return nil, err
+	}
+	log.V(logging.RequestVerbosity).Info("FreeNAS request", "status", resp.StatusCode, "duration", time.Since(start).String())
+
+	if debug {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		log.V(logging.BodyVerbosity).Info("FreeNAS response body", "status", resp.StatusCode, "body", redact(body))
+	}
+
+	return resp, nil
+}
+
+// redact returns a JSON body with the values of sensitive keys replaced
+func redact(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var data interface{}
+	if json.Unmarshal(body, &data) != nil {
+		return "<non JSON body redacted>"
+	}
+
+	b, _ := json.Marshal(redactValue(data))
+	return string(b)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch o := v.(type) {
+	case map[string]interface{}:
+		for k, value := range o {
+			if sensitiveKeys.MatchString(k) {
+				o[k] = "REDACTED"
+			} else {
+				o[k] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range o {
+			o[i] = redactValue(value)
+		}
+	}
+	return v
+}
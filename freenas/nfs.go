@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang/glog"
 )
 
 var (
@@ -49,71 +48,53 @@ func (n *NfsShare) CopyFrom(source FreenasResource) error {
 }
 
 func (n *NfsShare) Get(server *FreenasServer) error {
-	if n.Id > 0 {
-		endpoint := fmt.Sprintf("/api/v1.0/sharing/nfs/%d/", n.Id)
-		var nfs NfsShare
-		var e interface{}
-		resp, err := server.getSlingConnection().Get(endpoint).Receive(&nfs, &e)
+	id := n.Id
+	if id == 0 {
+		var err error
+		id, err = server.shareId(n.Paths[0])
 		if err != nil {
-			glog.Warningln(err)
 			return err
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			body, _ := json.Marshal(e)
-			return errors.New(fmt.Sprintf("Error getting NFS share \"%s\" - message: %v, status: %d", n.Paths, string(body), resp.StatusCode))
+		if id == 0 {
+			// Nothing found
+			return errors.New("No NfsShare has been found")
 		}
-
-		n.CopyFrom(&nfs)
-
-		return nil
 	}
 
-	endpoint := "/api/v1.0/sharing/nfs/?limit=1000"
-	var shares []NfsShare
+	endpoint := fmt.Sprintf("/api/v1.0/sharing/nfs/%d/", id)
+	var nfs NfsShare
 	var e interface{}
-	resp, err := server.getSlingConnection().Get(endpoint).Receive(&shares, &e)
-
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&nfs, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		if resp.StatusCode == 404 {
+			// deleted behind our back
+			server.shareIndex().update(id, nil)
+		}
 		body, _ := json.Marshal(e)
 		return errors.New(fmt.Sprintf("Error getting NFS share \"%s\" - message: %v, status: %d", n.Paths, string(body), resp.StatusCode))
 	}
 
-	for _, share := range shares {
-		if share.contains(n.Paths[0]) {
-			n.CopyFrom(&share)
-			return nil
-		}
-	}
+	n.CopyFrom(&nfs)
 
-	// Nothing found
-	return errors.New("No NfsShare has been found")
+	return nil
 }
 
-func (s *NfsShare) contains(path string) bool {
-	for _, p := range s.Paths {
-		if p == path {
-			return true
-		}
-	}
-
-	return false
+// CreateRequest returns the request creating the share
+func (n *NfsShare) CreateRequest() Request {
+	return Request{Method: "POST", Endpoint: "/api/v1.0/sharing/nfs/", Body: n}
 }
 
 func (n *NfsShare) Create(server *FreenasServer) error {
-	endpoint := "/api/v1.0/sharing/nfs/"
+	request := n.CreateRequest()
 	var nfs NfsShare
 	var e interface{}
-	resp, err := server.getSlingConnection().Post(endpoint).BodyJSON(n).Receive(&nfs, &e)
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(&nfs, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -124,16 +105,81 @@ func (n *NfsShare) Create(server *FreenasServer) error {
 	}
 
 	n.CopyFrom(&nfs)
+	server.shareIndex().update(n.Id, n.Paths)
+
+	return nil
+}
+
+// nfsShareUpdate is the body of a share update, without omitempty so that
+// fields can be cleared (e.g. nfs_network)
+type nfsShareUpdate struct {
+	Alldirs      bool     `json:"nfs_alldirs"`
+	Comment      string   `json:"nfs_comment"`
+	Hosts        string   `json:"nfs_hosts"`
+	MapallUser   string   `json:"nfs_mapall_user"`
+	MapallGroup  string   `json:"nfs_mapall_group"`
+	MaprootUser  string   `json:"nfs_maproot_user"`
+	MaprootGroup string   `json:"nfs_maproot_group"`
+	Network      string   `json:"nfs_network"`
+	Paths        []string `json:"nfs_paths"`
+	Security     []string `json:"nfs_security"`
+	Quiet        bool     `json:"nfs_quiet"`
+	ReadOnly     bool     `json:"nfs_ro"`
+}
+
+// UpdateRequest returns the request replacing every setting of the share
+func (n *NfsShare) UpdateRequest() Request {
+	return Request{
+		Method:   "PUT",
+		Endpoint: fmt.Sprintf("/api/v1.0/sharing/nfs/%d/", n.Id),
+		Body: nfsShareUpdate{
+			Alldirs:      n.Alldirs,
+			Comment:      n.Comment,
+			Hosts:        n.Hosts,
+			MapallUser:   n.MapallUser,
+			MapallGroup:  n.MapallGroup,
+			MaprootUser:  n.MaprootUser,
+			MaprootGroup: n.MaprootGroup,
+			Network:      n.Network,
+			Paths:        n.Paths,
+			Security:     n.Security,
+			Quiet:        n.Quiet,
+			ReadOnly:     n.ReadOnly,
+		},
+	}
+}
+
+func (n *NfsShare) Update(server *FreenasServer) error {
+	request := n.UpdateRequest()
+	var nfs NfsShare
+	var e interface{}
+	resp, err := server.getSlingConnection().Put(request.Endpoint).BodyJSON(request.Body).Receive(&nfs, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error updating NFS share \"%s\" - message: %v, status: %d", n.Paths, string(body), resp.StatusCode))
+	}
+
+	n.CopyFrom(&nfs)
+	server.shareIndex().update(n.Id, n.Paths)
 
 	return nil
 }
 
+// DeleteRequest returns the request deleting the share
+func (n *NfsShare) DeleteRequest() Request {
+	return Request{Method: "DELETE", Endpoint: fmt.Sprintf("/api/v1.0/sharing/nfs/%d/", n.Id)}
+}
+
 func (n *NfsShare) Delete(server *FreenasServer) error {
-	endpoint := fmt.Sprintf("/api/v1.0/sharing/nfs/%d/", n.Id)
+	request := n.DeleteRequest()
 	var e interface{}
-	resp, err := server.getSlingConnection().Delete(endpoint).Receive(nil, &e)
+	resp, err := server.getSlingConnection().Delete(request.Endpoint).Receive(nil, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -142,6 +188,7 @@ func (n *NfsShare) Delete(server *FreenasServer) error {
 		body, _ := json.Marshal(e)
 		return errors.New(fmt.Sprintf("Error deleting NFS share \"%s\" - %v", n.Paths, string(body)))
 	}
+	server.shareIndex().update(n.Id, nil)
 
 	return nil
 }
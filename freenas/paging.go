@@ -0,0 +1,38 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	pageSize = 100
+)
+
+// listPages gets the items of a v1 list endpoint page by page (limit/offset) until a page
+// is not full, add decodes a page and returns its number of items
+func listPages(server *FreenasServer, endpoint, what string, add func(page json.RawMessage) (int, error)) error {
+	for offset := 0; ; offset += pageSize {
+		var page json.RawMessage
+		var e interface{}
+		resp, err := server.getSlingConnection().Get(fmt.Sprintf("%s?limit=%d&offset=%d", endpoint, pageSize, offset)).Receive(&page, &e)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			body, _ := json.Marshal(e)
+			return errors.New(fmt.Sprintf("Error listing %s - message: %v, status: %d", what, string(body), resp.StatusCode))
+		}
+
+		count, err := add(page)
+		if err != nil {
+			return err
+		}
+		if count < pageSize {
+			return nil
+		}
+	}
+}
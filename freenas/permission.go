@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/golang/glog"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"strconv"
+	"strings"
 )
 
 type Permission struct {
@@ -15,20 +17,115 @@ type Permission struct {
 	Group string `json:"mp_group"`
 }
 
+// PutRequest returns the request setting the permissions, with the v2 API
+// if User and Group are numeric as the v1 API only supports names
+func (p *Permission) PutRequest() Request {
+	uid, uidErr := strconv.Atoi(p.User)
+	gid, gidErr := strconv.Atoi(p.Group)
+	if uidErr != nil || gidErr != nil {
+		return Request{Method: "PUT", Endpoint: "/api/v1.0/storage/permission/", Body: p}
+	}
+
+	data := &struct {
+		Path    string          `json:"path"`
+		Mode    string          `json:"mode,omitempty"`
+		Uid     int             `json:"uid"`
+		Gid     int             `json:"gid"`
+		Options map[string]bool `json:"options"`
+	}{
+		Path: p.Path,
+		Mode: strings.TrimPrefix(p.Mode, "0"),
+		Uid:  uid,
+		Gid:  gid,
+		Options: map[string]bool{
+			"stripacl": p.Acl == "unix",
+		},
+	}
+	if p.Acl != "unix" {
+		// mode cannot be set along with an ACL
+		data.Mode = ""
+	}
+
+	return Request{Method: "POST", Endpoint: "/api/v2.0/filesystem/setperm", Body: data}
+}
+
+// Put sets the permissions, numeric User and Group are set as uid and gid
 func (p *Permission) Put(server *FreenasServer) error {
-	endpoint := "/api/v1.0/storage/permission/"
+	request := p.PutRequest()
+	status := 201
+	conn := server.getSlingConnection()
+	if request.Method == "POST" {
+		conn, status = conn.Post(request.Endpoint), 200
+	} else {
+		conn = conn.Put(request.Endpoint)
+	}
+
 	var e interface{}
-	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(p).Receive(nil, &e)
+	resp, err := conn.BodyJSON(request.Body).Receive(nil, &e)
 	if err != nil {
-		glog.Warningln(err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
+	if resp.StatusCode != status {
 		body, _ := json.Marshal(e)
 		return errors.New(fmt.Sprintf("Error updating permission - message: %v, status: %d", string(body), resp.StatusCode))
 	}
 
 	return nil
 }
+
+// PutRecursiveRequest returns the websocket call setting the permissions of the path and
+// everything below it, user and group names are resolved to their ids
+func (p *Permission) PutRecursiveRequest(server *FreenasServer) (Request, error) {
+	uid, err := strconv.Atoi(p.User)
+	if err != nil {
+		user := User{Username: p.User}
+		if err = user.Get(server); err != nil {
+			return Request{}, err
+		}
+		uid = user.Uid
+	}
+	gid, err := strconv.Atoi(p.Group)
+	if err != nil {
+		group := Group{Name: p.Group}
+		if err = group.Get(server); err != nil {
+			return Request{}, err
+		}
+		gid = group.Gid
+	}
+
+	data := map[string]interface{}{
+		"path": p.Path,
+		"uid":  uid,
+		"gid":  gid,
+		"options": map[string]bool{
+			"stripacl":  p.Acl == "unix",
+			"recursive": true,
+			"traverse":  false,
+		},
+	}
+	if p.Acl == "unix" {
+		data["mode"] = strings.TrimPrefix(p.Mode, "0")
+	}
+
+	return Request{Method: "CALL", Endpoint: "filesystem.setperm", Body: data}, nil
+}
+
+// PutRecursive sets the permissions of the path and everything below it,
+// through the websocket as it is a job which may take a while
+func (p *Permission) PutRecursive(server *FreenasServer) error {
+	request, err := p.PutRecursiveRequest(server)
+	if err != nil {
+		return err
+	}
+
+	err = server.Websocket().CallJob(request.Endpoint, []interface{}{request.Body}, nil, func(job *Job) {
+		server.Log.V(logging.RequestVerbosity).Info("Setting permissions", "path", p.Path, "job", job.Id, "percent", job.Progress.Percent, "progress", job.Progress.Description)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error updating permission recursively - %v", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	_ FreenasResource = &ReplicationTask{}
+)
+
+// ReplicationState is the state of the last run of a replication task
+type ReplicationState struct {
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReplicationTask pushes the snapshots of datasets to another server through SSH
+type ReplicationTask struct {
+	Id                    int              `json:"id,omitempty"`
+	Name                  string           `json:"name"`
+	Direction             string           `json:"direction"`
+	Transport             string           `json:"transport"`
+	SshCredentials        int              `json:"ssh_credentials"`
+	SourceDatasets        []string         `json:"source_datasets"`
+	TargetDataset         string           `json:"target_dataset"`
+	Recursive             bool             `json:"recursive"`
+	PeriodicSnapshotTasks []int            `json:"periodic_snapshot_tasks"`
+	RetentionPolicy       string           `json:"retention_policy"`
+	Auto                  bool             `json:"auto"`
+	Enabled               bool             `json:"enabled"`
+	State                 ReplicationState `json:"-"`
+}
+
+func (r *ReplicationTask) UnmarshalJSON(data []byte) error {
+	type replicationTask ReplicationTask
+	task := &struct {
+		*replicationTask
+		SshCredentials interface{}      `json:"ssh_credentials"`
+		Tasks          []interface{}    `json:"periodic_snapshot_tasks"`
+		State          ReplicationState `json:"state"`
+	}{
+		replicationTask: (*replicationTask)(r),
+	}
+	err := json.Unmarshal(data, task)
+	if err != nil {
+		return err
+	}
+
+	// ssh credentials and snapshot tasks are returned expanded
+	r.SshCredentials = expandedId(task.SshCredentials)
+	r.PeriodicSnapshotTasks = nil
+	for _, t := range task.Tasks {
+		r.PeriodicSnapshotTasks = append(r.PeriodicSnapshotTasks, expandedId(t))
+	}
+	r.State = task.State
+
+	return nil
+}
+
+// expandedId returns the id of an object which may be expanded by the API
+func expandedId(v interface{}) int {
+	switch o := v.(type) {
+	case float64:
+		return int(o)
+	case map[string]interface{}:
+		if id, ok := o["id"].(float64); ok {
+			return int(id)
+		}
+	}
+	return 0
+}
+
+func (r *ReplicationTask) CopyFrom(source FreenasResource) error {
+	src, ok := source.(*ReplicationTask)
+	if ok {
+		r.Id = src.Id
+		r.Name = src.Name
+		r.Direction = src.Direction
+		r.Transport = src.Transport
+		r.SshCredentials = src.SshCredentials
+		r.SourceDatasets = src.SourceDatasets
+		r.TargetDataset = src.TargetDataset
+		r.Recursive = src.Recursive
+		r.PeriodicSnapshotTasks = src.PeriodicSnapshotTasks
+		r.RetentionPolicy = src.RetentionPolicy
+		r.Auto = src.Auto
+		r.Enabled = src.Enabled
+		r.State = src.State
+	}
+
+	return errors.New("Cannot copy, src is not a ReplicationTask")
+}
+
+func (r *ReplicationTask) Get(server *FreenasServer) error {
+	endpoint := fmt.Sprintf("/api/v2.0/replication/id/%d", r.Id)
+	var task ReplicationTask
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&task, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error getting replication task \"%d\" - message: %v, status: %d", r.Id, string(body), resp.StatusCode))
+	}
+
+	r.CopyFrom(&task)
+
+	return nil
+}
+
+// CreateRequest returns the request creating the task
+func (r *ReplicationTask) CreateRequest() Request {
+	return Request{Method: "POST", Endpoint: "/api/v2.0/replication", Body: r}
+}
+
+func (r *ReplicationTask) Create(server *FreenasServer) error {
+	request := r.CreateRequest()
+	var task ReplicationTask
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(&task, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating replication task \"%s\" - message: %v, status: %d", r.Name, string(body), resp.StatusCode))
+	}
+
+	r.CopyFrom(&task)
+
+	return nil
+}
+
+// DeleteRequest returns the request deleting the task
+func (r *ReplicationTask) DeleteRequest() Request {
+	return Request{Method: "DELETE", Endpoint: fmt.Sprintf("/api/v2.0/replication/id/%d", r.Id)}
+}
+
+func (r *ReplicationTask) Delete(server *FreenasServer) error {
+	request := r.DeleteRequest()
+	var e interface{}
+	resp, err := server.getSlingConnection().Delete(request.Endpoint).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error deleting replication task \"%d\" - %v", r.Id, string(body)))
+	}
+
+	return nil
+}
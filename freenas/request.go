@@ -0,0 +1,32 @@
+package freenas
+
+import (
+	"encoding/json"
+)
+
+// Request is a change a resource sends to the API (or a method called through
+// the websocket), as described by dry runs
+type Request struct {
+	Method   string
+	Endpoint string
+	Body     interface{}
+}
+
+// Payload returns the JSON body of the request, secrets being redacted
+func (r Request) Payload() string {
+	if r.Body == nil {
+		return ""
+	}
+	b, err := json.Marshal(r.Body)
+	if err != nil {
+		return "<invalid body: " + err.Error() + ">"
+	}
+	return redact(b)
+}
+
+func (r Request) String() string {
+	if r.Body == nil {
+		return r.Method + " " + r.Endpoint
+	}
+	return r.Method + " " + r.Endpoint + " " + r.Payload()
+}
@@ -1,10 +1,16 @@
 package freenas
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"github.com/dghubble/sling"
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/logging"
 	"net/http"
+	"strconv"
 )
 
 type FreenasResource interface {
@@ -17,33 +23,91 @@ type FreenasResource interface {
 type FreenasServer struct {
 	Protocol                 string
 	Host, Username, Password string
+	ApiKey                   string
 	Port                     int
 	InsecureSkipVerify       bool
 	url                      string
+	httpClient               *http.Client
+	tlsConfig                *tls.Config
+	// credentials is a digest of the credentials and TLS options, to detect their changes
+	credentials string
+
+	// Log logs the requests, RequestId correlates them with the operation they are part of
+	Log       logr.Logger
+	RequestId string
+
+	// requests are traced as children of the span of ctx
+	ctx context.Context
 }
 
-func NewFreenasServer(protocol string, host string, port int, username, password string, insecure bool) *FreenasServer {
+// NewFreenasServer returns a server authenticating with apiKey as a bearer token
+// if set, with username and password otherwise
+func NewFreenasServer(protocol string, host string, port int, username, password, apiKey string, tlsOptions TLSOptions) (*FreenasServer, error) {
 	u := fmt.Sprintf("%s://%s:%d", protocol, host, port)
+
+	var tr http.RoundTripper = &http.Transport{}
+	var tlsConfig *tls.Config
+	if protocol != "http" {
+		var err error
+		tlsConfig, err = newTLSConfig(tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		tr = &tlsErrorTransport{
+			transport: &http.Transport{TLSClientConfig: tlsConfig},
+			host:      host,
+		}
+	}
+
 	return &FreenasServer{
 		Protocol:           protocol,
 		Host:               host,
 		Port:               port,
 		Username:           username,
 		Password:           password,
-		InsecureSkipVerify: insecure,
+		ApiKey:             apiKey,
+		InsecureSkipVerify: tlsOptions.InsecureSkipVerify,
 		url:                u,
+		httpClient:         &http.Client{Transport: tr},
+		tlsConfig:          tlsConfig,
+		credentials:        credentialsDigest(username, password, apiKey, tlsOptions),
+		Log:                logging.Log.WithValues("host", host),
+	}, nil
+}
+
+// credentialsDigest returns a digest of the credentials and TLS options of a server
+func credentialsDigest(username, password, apiKey string, tlsOptions TLSOptions) string {
+	h := sha256.New()
+	for _, v := range [][]byte{
+		[]byte(username), []byte(password), []byte(apiKey),
+		[]byte(strconv.FormatBool(tlsOptions.InsecureSkipVerify)),
+		tlsOptions.CACert, tlsOptions.ClientCert, tlsOptions.ClientKey,
+		[]byte(tlsOptions.ServerName), []byte(tlsOptions.SPKIPin),
+	} {
+		// length prefixed so values cannot be shifted from one field to the next
+		fmt.Fprintf(h, "%d:", len(v))
+		h.Write(v)
 	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WithContext returns a copy of the server tracing its requests as children of the span of ctx
+func (s *FreenasServer) WithContext(ctx context.Context) *FreenasServer {
+	server := *s
+	server.ctx = ctx
+	return &server
 }
 
 func (s *FreenasServer) getSlingConnection() *sling.Sling {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify},
+	doer := &loggingDoer{
+		client:    s.httpClient,
+		log:       s.Log,
+		requestId: s.RequestId,
+		ctx:       s.ctx,
 	}
-
-	if s.Protocol == "http" {
-		tr.TLSClientConfig = nil
+	conn := sling.New().Doer(doer).Base(s.url).Set("Accept", "application/json").Set("Content-Type", "application/json")
+	if s.ApiKey != "" {
+		return conn.Set("Authorization", "Bearer "+s.ApiKey)
 	}
-
-	httpClient := &http.Client{Transport: tr}
-	return sling.New().Client(httpClient).Base(s.url).SetBasicAuth(s.Username, s.Password).Set("Accept", "application/json").Set("Content-Type", "application/json")
+	return conn.SetBasicAuth(s.Username, s.Password)
 }
@@ -0,0 +1,205 @@
+package freenas
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// versionHandler answers the version endpoint and records the headers of the request
+func versionHandler(headers *http.Header) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*headers = r.Header.Clone()
+		w.Write([]byte(`{"fullversion":"FreeNAS-11.3-U5"}`))
+	}
+}
+
+// newTestServer returns a FreenasServer talking to srv
+func newTestServer(t *testing.T, srv *httptest.Server, username, password, apiKey string, tlsOptions TLSOptions) *FreenasServer {
+	t.Helper()
+	u := strings.SplitN(srv.URL, "://", 2)
+	host, port, err := net.SplitHostPort(u[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	server, err := NewFreenasServer(u[0], host, p, username, password, apiKey, tlsOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// newClientCert returns a CA and a client certificate (and key) it signed, PEM encoded
+func newClientCert(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "freenas-provisioner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestBasicAuth(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(versionHandler(&headers))
+	defer srv.Close()
+
+	server := newTestServer(t, srv, "root", "secret", "", TLSOptions{})
+	err := (&Version{}).Get(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Header: headers}
+	username, password, ok := req.BasicAuth()
+	if !ok || username != "root" || password != "secret" {
+		t.Errorf("expected basic auth root:secret, got %q", headers.Get("Authorization"))
+	}
+}
+
+func TestApiKeyAuth(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(versionHandler(&headers))
+	defer srv.Close()
+
+	server := newTestServer(t, srv, "root", "secret", "1-abcdef", TLSOptions{})
+	err := (&Version{}).Get(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := headers.Get("Authorization"); got != "Bearer 1-abcdef" {
+		t.Errorf("expected bearer api key, got %q", got)
+	}
+}
+
+func TestCustomCA(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewTLSServer(versionHandler(&headers))
+	defer srv.Close()
+
+	// not trusted by default
+	server := newTestServer(t, srv, "root", "secret", "", TLSOptions{})
+	err := (&Version{}).Get(server)
+	if err == nil || !strings.Contains(err.Error(), "not signed by a trusted CA") {
+		t.Errorf("expected an unknown authority error, got %v", err)
+	}
+
+	server = newTestServer(t, srv, "root", "secret", "", TLSOptions{CACert: certPEM(srv.Certificate())})
+	err = (&Version{}).Get(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	ca, cert, key := newClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	var headers http.Header
+	srv := httptest.NewUnstartedServer(versionHandler(&headers))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	server := newTestServer(t, srv, "root", "secret", "", TLSOptions{CACert: certPEM(srv.Certificate())})
+	err := (&Version{}).Get(server)
+	if err == nil {
+		t.Error("expected the server to reject a connection without client certificate")
+	}
+
+	server = newTestServer(t, srv, "root", "secret", "", TLSOptions{
+		CACert:     certPEM(srv.Certificate()),
+		ClientCert: cert,
+		ClientKey:  key,
+	})
+	err = (&Version{}).Get(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSPKIPin(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewTLSServer(versionHandler(&headers))
+	defer srv.Close()
+
+	server := newTestServer(t, srv, "root", "secret", "", TLSOptions{
+		InsecureSkipVerify: true,
+		SPKIPin:            "sha256//" + SPKIPin(srv.Certificate()),
+	})
+	err := (&Version{}).Get(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cert, _ := newClientCert(t)
+	block, _ := pem.Decode(cert)
+	other, _ := x509.ParseCertificate(block.Bytes)
+	server = newTestServer(t, srv, "root", "secret", "", TLSOptions{
+		InsecureSkipVerify: true,
+		SPKIPin:            SPKIPin(other),
+	})
+	err = (&Version{}).Get(server)
+	if err == nil || !strings.Contains(err.Error(), "is not pinned") {
+		t.Errorf("expected a pin mismatch error, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Service is the state of a FreeNAS service (e.g. nfs, cifs, ssh)
+type Service struct {
+	Id   int    `json:"id,omitempty"`
+	Name string `json:"service"`
+	// Enabled is whether the service is started on boot
+	Enabled bool `json:"enable"`
+	// State is the current state of the service (RUNNING, STOPPED...)
+	State string `json:"state"`
+}
+
+// Running returns whether the service is currently running
+func (s *Service) Running() bool {
+	return s.State == "RUNNING"
+}
+
+func (s *Service) Get(server *FreenasServer) error {
+	endpoint := "/api/v2.0/service?service=" + url.QueryEscape(s.Name)
+	var services []Service
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&services, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error getting service \"%s\" - message: %v, status: %d", s.Name, string(body), resp.StatusCode))
+	}
+
+	for _, service := range services {
+		if service.Name == s.Name {
+			*s = service
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Error getting service \"%s\" - not found", s.Name))
+}
+
+// NfsService is the global configuration of the NFS service
+type NfsService struct {
+	Id           int    `json:"id,omitempty"`
+	Servers      int    `json:"nfs_srv_servers,omitempty"`
+	Udp          bool   `json:"nfs_srv_udp"`
+	AllowNonroot bool   `json:"nfs_srv_allow_nonroot"`
+	BindIp       string `json:"nfs_srv_bindip"`
+	V4           bool   `json:"nfs_srv_v4"`
+	V4V3Owner    bool   `json:"nfs_srv_v4_v3owner"`
+	V4Krb        bool   `json:"nfs_srv_v4_krb"`
+}
+
+func (n *NfsService) Get(server *FreenasServer) error {
+	endpoint := "/api/v1.0/services/nfs/"
+	var nfs NfsService
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&nfs, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error getting NFS service configuration - message: %v, status: %d", string(body), resp.StatusCode))
+	}
+
+	*n = nfs
+
+	return nil
+}
+
+// PutRequest returns the request updating the configuration of the NFS service
+func (n *NfsService) PutRequest() Request {
+	return Request{Method: "PUT", Endpoint: "/api/v1.0/services/nfs/", Body: n}
+}
+
+func (n *NfsService) Put(server *FreenasServer) error {
+	request := n.PutRequest()
+	var nfs NfsService
+	var e interface{}
+	resp, err := server.getSlingConnection().Put(request.Endpoint).BodyJSON(request.Body).Receive(&nfs, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error updating NFS service configuration - message: %v, status: %d", string(body), resp.StatusCode))
+	}
+
+	*n = nfs
+
+	return nil
+}
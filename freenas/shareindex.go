@@ -0,0 +1,148 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	shareIndexTTL = 30 * time.Second
+)
+
+var (
+	shareIndexes   = map[string]*shareIndex{}
+	shareIndexesMu sync.Mutex
+)
+
+// shareIndex maps the paths exported by the NFS shares of a server to their id, paths are
+// looked up with the path filter of the v2 API if the server supports it, in the index otherwise
+type shareIndex struct {
+	mu         sync.Mutex
+	ids        map[string]int
+	expires    time.Time
+	probed     bool
+	pathFilter bool
+}
+
+// shareIndex returns the share index of the server
+func (s *FreenasServer) shareIndex() *shareIndex {
+	shareIndexesMu.Lock()
+	defer shareIndexesMu.Unlock()
+
+	index, ok := shareIndexes[s.url]
+	if !ok {
+		index = &shareIndex{}
+		shareIndexes[s.url] = index
+	}
+	return index
+}
+
+// shareId returns the id of the share exporting path, 0 if there is none
+func (s *FreenasServer) shareId(path string) (int, error) {
+	index := s.shareIndex()
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if index.pathFilter {
+		return findShareId(s, path)
+	}
+
+	if index.ids == nil || time.Now().After(index.expires) {
+		err := index.load(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return index.ids[path], nil
+}
+
+// load lists every share of the server, and checks once whether it supports the v2 path filter
+func (i *shareIndex) load(server *FreenasServer) error {
+	shares, err := listShares(server)
+	if err != nil {
+		return err
+	}
+
+	i.ids = map[string]int{}
+	for _, share := range shares {
+		for _, path := range share.Paths {
+			i.ids[path] = share.Id
+		}
+	}
+	i.expires = time.Now().Add(shareIndexTTL)
+
+	if !i.probed && len(shares) > 0 && len(shares[0].Paths) > 0 {
+		id, err := findShareId(server, shares[0].Paths[0])
+		i.pathFilter = err == nil && id == shares[0].Id
+		i.probed = true
+	}
+
+	return nil
+}
+
+// update sets the paths of a share in the index (none if it has been deleted)
+func (i *shareIndex) update(id int, paths []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.ids == nil {
+		return
+	}
+	for path, pathId := range i.ids {
+		if pathId == id {
+			delete(i.ids, path)
+		}
+	}
+	for _, path := range paths {
+		i.ids[path] = id
+	}
+}
+
+// listShares returns every NFS share of the server, page by page
+func listShares(server *FreenasServer) ([]NfsShare, error) {
+	var shares []NfsShare
+	err := listPages(server, "/api/v1.0/sharing/nfs/", "NFS shares", func(data json.RawMessage) (int, error) {
+		var page []NfsShare
+		err := json.Unmarshal(data, &page)
+		shares = append(shares, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+// findShareId returns the id of the share exporting path using the path filter of the v2 API, 0 if there is none
+func findShareId(server *FreenasServer, path string) (int, error) {
+	endpoint := "/api/v2.0/sharing/nfs?path=" + url.QueryEscape(path)
+	var shares []struct {
+		Id   int    `json:"id"`
+		Path string `json:"path"`
+	}
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&shares, &e)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return 0, errors.New(fmt.Sprintf("Error finding NFS share \"%s\" - message: %v, status: %d", path, string(body), resp.StatusCode))
+	}
+
+	for _, share := range shares {
+		if share.Path == path {
+			return share.Id, nil
+		}
+	}
+
+	return 0, nil
+}
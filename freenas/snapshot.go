@@ -0,0 +1,194 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+var (
+	_ FreenasResource = &SnapshotTask{}
+)
+
+// Schedule is a cron like schedule
+type Schedule struct {
+	Minute string `json:"minute"`
+	Hour   string `json:"hour"`
+	Dom    string `json:"dom"`
+	Month  string `json:"month"`
+	Dow    string `json:"dow"`
+}
+
+// SnapshotTask is a periodic snapshot task of a dataset
+type SnapshotTask struct {
+	Id            int      `json:"id,omitempty"`
+	Dataset       string   `json:"dataset"`
+	Recursive     bool     `json:"recursive"`
+	LifetimeValue int      `json:"lifetime_value"`
+	LifetimeUnit  string   `json:"lifetime_unit"`
+	NamingSchema  string   `json:"naming_schema"`
+	Schedule      Schedule `json:"schedule"`
+	Enabled       bool     `json:"enabled"`
+}
+
+func (t *SnapshotTask) CopyFrom(source FreenasResource) error {
+	src, ok := source.(*SnapshotTask)
+	if ok {
+		t.Id = src.Id
+		t.Dataset = src.Dataset
+		t.Recursive = src.Recursive
+		t.LifetimeValue = src.LifetimeValue
+		t.LifetimeUnit = src.LifetimeUnit
+		t.NamingSchema = src.NamingSchema
+		t.Schedule = src.Schedule
+		t.Enabled = src.Enabled
+	}
+
+	return errors.New("Cannot copy, src is not a SnapshotTask")
+}
+
+func (t *SnapshotTask) Get(server *FreenasServer) error {
+	endpoint := fmt.Sprintf("/api/v2.0/pool/snapshottask/id/%d", t.Id)
+	var task SnapshotTask
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&task, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error getting snapshot task \"%d\" - message: %v, status: %d", t.Id, string(body), resp.StatusCode))
+	}
+
+	t.CopyFrom(&task)
+
+	return nil
+}
+
+// CreateRequest returns the request creating the task
+func (t *SnapshotTask) CreateRequest() Request {
+	return Request{Method: "POST", Endpoint: "/api/v2.0/pool/snapshottask", Body: t}
+}
+
+func (t *SnapshotTask) Create(server *FreenasServer) error {
+	request := t.CreateRequest()
+	var task SnapshotTask
+	var e interface{}
+	resp, err := server.getSlingConnection().Post(request.Endpoint).BodyJSON(request.Body).Receive(&task, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error creating snapshot task for \"%s\" - message: %v, status: %d", t.Dataset, string(body), resp.StatusCode))
+	}
+
+	t.CopyFrom(&task)
+
+	return nil
+}
+
+// DeleteRequest returns the request deleting the task
+func (t *SnapshotTask) DeleteRequest() Request {
+	return Request{Method: "DELETE", Endpoint: fmt.Sprintf("/api/v2.0/pool/snapshottask/id/%d", t.Id)}
+}
+
+func (t *SnapshotTask) Delete(server *FreenasServer) error {
+	request := t.DeleteRequest()
+	var e interface{}
+	resp, err := server.getSlingConnection().Delete(request.Endpoint).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error deleting snapshot task \"%d\" - %v", t.Id, string(body)))
+	}
+
+	return nil
+}
+
+// FindSnapshotTask returns the task of a dataset using the given naming schema, nil if there is none
+func FindSnapshotTask(server *FreenasServer, dataset, namingSchema string) (*SnapshotTask, error) {
+	endpoint := "/api/v2.0/pool/snapshottask?dataset=" + url.QueryEscape(dataset)
+	var tasks []SnapshotTask
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&tasks, &e)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, errors.New(fmt.Sprintf("Error listing snapshot tasks of \"%s\" - message: %v, status: %d", dataset, string(body), resp.StatusCode))
+	}
+
+	for i := range tasks {
+		if tasks[i].Dataset == dataset && tasks[i].NamingSchema == namingSchema {
+			return &tasks[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Snapshot is a ZFS snapshot
+type Snapshot struct {
+	Id      string `json:"id"`
+	Dataset string `json:"dataset"`
+	Name    string `json:"snapshot_name"`
+}
+
+// ListSnapshots returns the snapshots of a dataset sorted by name
+func ListSnapshots(server *FreenasServer, dataset string) ([]Snapshot, error) {
+	endpoint := "/api/v2.0/zfs/snapshot?dataset=" + url.QueryEscape(dataset)
+	var snapshots []Snapshot
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&snapshots, &e)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, errors.New(fmt.Sprintf("Error listing snapshots of \"%s\" - message: %v, status: %d", dataset, string(body), resp.StatusCode))
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+
+	return snapshots, nil
+}
+
+// DeleteRequest returns the request deleting the snapshot
+func (s *Snapshot) DeleteRequest() Request {
+	return Request{Method: "DELETE", Endpoint: "/api/v2.0/zfs/snapshot/id/" + url.PathEscape(s.Id)}
+}
+
+func (s *Snapshot) Delete(server *FreenasServer) error {
+	request := s.DeleteRequest()
+	var e interface{}
+	resp, err := server.getSlingConnection().Delete(request.Endpoint).Receive(nil, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error deleting snapshot \"%s\" - %v", s.Id, string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package freenas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the FreeNAS system
+type Version struct {
+	FullVersion string `json:"fullversion"`
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+}
+
+func (v *Version) Get(server *FreenasServer) error {
+	endpoint := "/api/v1.0/system/version/"
+	var version Version
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&version, &e)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return errors.New(fmt.Sprintf("Error getting system version - message: %v, status: %d", string(body), resp.StatusCode))
+	}
+
+	*v = version
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package freenas
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TLSOptions are the settings of https connections, certificates are PEM encoded
+type TLSOptions struct {
+	InsecureSkipVerify bool
+	CACert             []byte
+	ClientCert         []byte
+	ClientKey          []byte
+	// ServerName overrides the host name used for SNI and certificate verification
+	ServerName string
+	// SPKIPin is the base64 encoded SHA-256 of the subject public key info of
+	// a certificate of the server chain (ie: sha256//<base64>)
+	SPKIPin string
+}
+
+// SPKIPinError is returned when no certificate of the server chain matches the pin
+type SPKIPinError struct {
+	Pin string
+}
+
+func (e *SPKIPinError) Error() string {
+	return fmt.Sprintf("no certificate of the server chain matches the SPKI pin \"%s\"", e.Pin)
+}
+
+// SPKIPin returns the pin of a certificate
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipVerify,
+		ServerName:         options.ServerName,
+	}
+
+	if len(options.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(options.CACert) {
+			return nil, errors.New("Cannot parse CA certificate, expected PEM encoded certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(options.ClientCert) > 0 || len(options.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair(options.ClientCert, options.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if options.SPKIPin != "" {
+		pin := strings.TrimPrefix(options.SPKIPin, "sha256//")
+		decoded, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("Invalid SPKI pin \"%s\", expected a base64 encoded SHA-256", options.SPKIPin)
+		}
+
+		// checked along with the chain verification, or alone if verification is skipped
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if SPKIPin(cert) == pin {
+					return nil
+				}
+			}
+			return &SPKIPinError{Pin: pin}
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// tlsErrorTransport explains certificate verification failures
+type tlsErrorTransport struct {
+	transport http.RoundTripper
+	host      string
+}
+
+func (t *tlsErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var pin *SPKIPinError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return nil, fmt.Errorf("Certificate of server \"%s\" is not signed by a trusted CA, set caCert to the CA bundle of the server: %v", t.host, err)
+	case errors.As(err, &hostname):
+		return nil, fmt.Errorf("Certificate of server \"%s\" does not match the host name, set serverName to a name of the certificate: %v", t.host, err)
+	case errors.As(err, &invalid):
+		return nil, fmt.Errorf("Certificate of server \"%s\" is invalid: %v", t.host, err)
+	case errors.As(err, &pin):
+		return nil, fmt.Errorf("Certificate of server \"%s\" is not pinned: %v", t.host, err)
+	}
+
+	return nil, err
+}
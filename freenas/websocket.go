@@ -0,0 +1,530 @@
+package freenas
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	websocketCallTimeout = 60 * time.Second
+	websocketDialTimeout = 30 * time.Second
+	websocketJobPoll     = 5 * time.Second
+)
+
+var (
+	errWebsocketClosed = errors.New("websocket connection closed")
+
+	// connections are shared by all FreenasServer instances with the same url
+	websocketClients   = map[string]*WebsocketClient{}
+	websocketClientsMu sync.Mutex
+)
+
+// wsMessage is a DDP message of the TrueNAS middleware
+type wsMessage struct {
+	Msg    string          `json:"msg"`
+	Id     interface{}     `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params []interface{}   `json:"params,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *WebsocketError `json:"error,omitempty"`
+
+	// connect message
+	Version string   `json:"version,omitempty"`
+	Support []string `json:"support,omitempty"`
+
+	// collection events
+	Collection string `json:"collection,omitempty"`
+}
+
+// WebsocketError is an error returned by a middleware method
+type WebsocketError struct {
+	Errno  int    `json:"error"`
+	Name   string `json:"errname"`
+	Reason string `json:"reason"`
+}
+
+func (e *WebsocketError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Name, e.Errno, e.Reason)
+}
+
+// Event is a change of a collection the client subscribed to
+type Event struct {
+	Msg        string          `json:"msg"`
+	Collection string          `json:"collection"`
+	Id         interface{}     `json:"id"`
+	Fields     json.RawMessage `json:"fields"`
+}
+
+// Job is a long running middleware operation
+type Job struct {
+	Id       int    `json:"id"`
+	Method   string `json:"method"`
+	State    string `json:"state"`
+	Progress struct {
+		Percent     float64 `json:"percent"`
+		Description string  `json:"description"`
+	} `json:"progress"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// Finished returns whether the job is over (successfully or not)
+func (j *Job) Finished() bool {
+	return j.State == "SUCCESS" || j.State == "FAILED" || j.State == "ABORTED"
+}
+
+type wsSubscription struct {
+	id        string
+	listeners []chan Event
+}
+
+// WebsocketClient is a persistent authenticated connection to the middleware (wss://<host>/websocket)
+// calls are multiplexed on the connection, which is reopened and authenticated again when lost
+// or when the credentials or TLS options of the server change
+type WebsocketClient struct {
+	host string
+	log  logr.Logger
+
+	// dialMu serializes the connections, connMu guards server and conn
+	dialMu sync.Mutex
+	connMu sync.Mutex
+	server *FreenasServer
+	conn   *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	nextId        uint64
+	pending       map[string]chan *wsMessage
+	subscriptions map[string]*wsSubscription
+}
+
+// Websocket returns the websocket client of the server
+func (s *FreenasServer) Websocket() *WebsocketClient {
+	websocketClientsMu.Lock()
+	client, ok := websocketClients[s.url]
+	if !ok {
+		client = &WebsocketClient{
+			host:          s.Host,
+			log:           logging.Log.WithValues("host", s.Host),
+			server:        s,
+			pending:       map[string]chan *wsMessage{},
+			subscriptions: map[string]*wsSubscription{},
+		}
+		websocketClients[s.url] = client
+	}
+	websocketClientsMu.Unlock()
+
+	if ok {
+		client.refresh(s)
+	}
+	return client
+}
+
+// refresh closes the connection if it was authenticated with other credentials or TLS options
+func (c *WebsocketClient) refresh(s *FreenasServer) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.server.credentials == s.credentials {
+		return
+	}
+	c.server = s
+	if c.conn != nil {
+		c.log.V(logging.RequestVerbosity).Info("Server credentials changed, reopening websocket connection")
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// connection returns the current connection, opening and authenticating a new one if needed
+func (c *WebsocketClient) connection() (*websocket.Conn, error) {
+	c.connMu.Lock()
+	conn := c.conn
+	c.connMu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+
+	// another call may have connected meanwhile
+	c.connMu.Lock()
+	conn, server := c.conn, c.server
+	c.connMu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := c.dial(server)
+	if err != nil {
+		return nil, err
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.server.credentials != server.credentials {
+		// refreshed while connecting
+		conn.Close()
+		return nil, errWebsocketClosed
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// dial opens and authenticates a connection, the TCP, TLS and websocket handshakes
+// are bounded by websocketDialTimeout and authentication by websocketCallTimeout
+func (c *WebsocketClient) dial(server *FreenasServer) (*websocket.Conn, error) {
+	scheme := "ws"
+	if server.Protocol != "http" {
+		scheme = "wss"
+	}
+	config, err := websocket.NewConfig(
+		fmt.Sprintf("%s://%s:%d/websocket", scheme, server.Host, server.Port),
+		fmt.Sprintf("%s://%s:%d", server.Protocol, server.Host, server.Port),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	dialer := &net.Dialer{Timeout: websocketDialTimeout}
+	var netConn net.Conn
+	if scheme == "wss" {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", address, server.tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(websocketDialTimeout))
+
+	conn, err := websocket.NewClient(config, netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// DDP handshake
+	err = websocket.JSON.Send(conn, &wsMessage{Msg: "connect", Version: "1", Support: []string{"1"}})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var connected wsMessage
+	err = websocket.JSON.Receive(conn, &connected)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connected.Msg != "connected" {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot connect to websocket of \"%s\", got \"%s\" message", c.host, connected.Msg)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	go c.read(conn)
+
+	// authenticate
+	method, params := "auth.login", []interface{}{server.Username, server.Password}
+	if server.ApiKey != "" {
+		method, params = "auth.login_with_api_key", []interface{}{server.ApiKey}
+	}
+	var ok bool
+	err = c.callOn(conn, method, params, &ok)
+	if err == nil && !ok {
+		err = fmt.Errorf("Cannot authenticate to websocket of \"%s\"", c.host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// subscriptions are lost along with the previous connection
+	c.mu.Lock()
+	for name, sub := range c.subscriptions {
+		err = c.send(conn, &wsMessage{Msg: "sub", Id: sub.id, Name: name})
+		if err != nil {
+			c.log.Error(err, "Cannot subscribe", "collection", name)
+		}
+	}
+	c.mu.Unlock()
+
+	return conn, nil
+}
+
+func (c *WebsocketClient) send(conn *websocket.Conn, msg *wsMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return websocket.JSON.Send(conn, msg)
+}
+
+// read dispatches the messages of a connection until it is closed
+func (c *WebsocketClient) read(conn *websocket.Conn) {
+	for {
+		var data []byte
+		var msg wsMessage
+		err := websocket.Message.Receive(conn, &data)
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			c.log.Error(err, "Websocket connection lost")
+			conn.Close()
+			c.closed(conn)
+			return
+		}
+
+		switch msg.Msg {
+		case "result":
+			id := fmt.Sprint(msg.Id)
+			c.mu.Lock()
+			ch, ok := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ok {
+				ch <- &msg
+			}
+		case "ping":
+			c.send(conn, &wsMessage{Msg: "pong", Id: msg.Id})
+		case "added", "changed", "removed":
+			var event Event
+			if json.Unmarshal(data, &event) != nil {
+				continue
+			}
+			c.mu.Lock()
+			if sub, ok := c.subscriptions[msg.Collection]; ok {
+				for _, listener := range sub.listeners {
+					select {
+					case listener <- event:
+					default:
+						c.log.Info("Dropping event, listener is not keeping up", "collection", msg.Collection)
+					}
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// closed fails the pending calls of a lost connection
+func (c *WebsocketClient) closed(conn *websocket.Conn) {
+	// pending calls first as the connection may still be authenticating
+	c.mu.Lock()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	c.connMu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.connMu.Unlock()
+}
+
+func (c *WebsocketClient) newId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextId++
+	return strconv.FormatUint(c.nextId, 10)
+}
+
+// callOn calls a method on the given connection and decodes its result
+func (c *WebsocketClient) callOn(conn *websocket.Conn, method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	id := c.newId()
+	ch := make(chan *wsMessage, 1)
+
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	err := c.send(conn, &wsMessage{Msg: "method", Id: id, Method: method, Params: params})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return errWebsocketClosed
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return errWebsocketClosed
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-time.After(websocketCallTimeout):
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return fmt.Errorf("Timeout calling \"%s\" on \"%s\"", method, c.host)
+	}
+}
+
+// Call calls a middleware method and decodes its result, a lost connection is reopened once
+func (c *WebsocketClient) Call(method string, params []interface{}, result interface{}) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *websocket.Conn
+		conn, err = c.connection()
+		if err != nil {
+			return err
+		}
+
+		err = c.callOn(conn, method, params, result)
+		if err != errWebsocketClosed {
+			return err
+		}
+	}
+	return err
+}
+
+// Subscribe returns the events of a collection (ie: core.get_jobs) until unsubscribe is called
+func (c *WebsocketClient) Subscribe(name string) (<-chan Event, func(), error) {
+	conn, err := c.connection()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener := make(chan Event, 64)
+	id := c.newId()
+
+	c.mu.Lock()
+	sub, ok := c.subscriptions[name]
+	if !ok {
+		sub = &wsSubscription{id: id}
+		c.subscriptions[name] = sub
+	}
+	sub.listeners = append(sub.listeners, listener)
+	c.mu.Unlock()
+
+	if !ok {
+		err = c.send(conn, &wsMessage{Msg: "sub", Id: sub.id, Name: name})
+		if err != nil {
+			c.log.Error(err, "Cannot subscribe", "collection", name)
+		}
+	}
+
+	unsubscribe := func() {
+		c.mu.Lock()
+		for i, l := range sub.listeners {
+			if l == listener {
+				sub.listeners = append(sub.listeners[:i], sub.listeners[i+1:]...)
+				break
+			}
+		}
+		last := len(sub.listeners) == 0 && c.subscriptions[name] == sub
+		if last {
+			delete(c.subscriptions, name)
+		}
+		c.mu.Unlock()
+
+		if last {
+			c.connMu.Lock()
+			conn := c.conn
+			c.connMu.Unlock()
+			if conn != nil {
+				c.send(conn, &wsMessage{Msg: "unsub", Id: sub.id})
+			}
+		}
+	}
+
+	return listener, unsubscribe, nil
+}
+
+// CallJob calls a method starting a job and waits for it, decoding the job result
+func (c *WebsocketClient) CallJob(method string, params []interface{}, result interface{}, progress func(*Job)) error {
+	var id int
+	err := c.Call(method, params, &id)
+	if err != nil {
+		return err
+	}
+
+	job, err := c.WaitJob(id, progress)
+	if err != nil {
+		return err
+	}
+
+	if result != nil && len(job.Result) > 0 {
+		return json.Unmarshal(job.Result, result)
+	}
+	return nil
+}
+
+// WaitJob follows the progress of a job until it is over, an error is returned if it did not succeed
+func (c *WebsocketClient) WaitJob(id int, progress func(*Job)) (*Job, error) {
+	events, unsubscribe, err := c.Subscribe("core.get_jobs")
+	if err != nil {
+		return nil, err
+	}
+	defer unsubscribe()
+
+	ticker := time.NewTicker(websocketJobPoll)
+	defer ticker.Stop()
+
+	// the job may be over before the subscription, and events may be lost on reconnection
+	poll := func() (*Job, error) {
+		var jobs []Job
+		err := c.Call("core.get_jobs", []interface{}{[]interface{}{[]interface{}{"id", "=", id}}}, &jobs)
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) == 0 {
+			return nil, fmt.Errorf("Cannot find job \"%d\"", id)
+		}
+		return &jobs[0], nil
+	}
+
+	job, err := poll()
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(job)
+		}
+		if job.Finished() {
+			if job.State != "SUCCESS" {
+				return job, fmt.Errorf("Job \"%d\" (%s) %s: %s", job.Id, job.Method, job.State, job.Error)
+			}
+			return job, nil
+		}
+
+		select {
+		case event := <-events:
+			if eventId, ok := event.Id.(float64); !ok || int(eventId) != id {
+				continue
+			}
+			var update Job
+			if json.Unmarshal(event.Fields, &update) != nil {
+				continue
+			}
+			job, err = &update, nil
+		case <-ticker.C:
+			job, err = poll()
+		}
+	}
+}
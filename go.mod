@@ -5,10 +5,20 @@ go 1.15
 require (
 	code.cloudfoundry.org/bytefmt v0.0.0-20200131002437-cf55d5288a48
 	github.com/dghubble/sling v1.3.0
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/go-logr/logr v0.2.0
+	github.com/go-logr/zapr v0.2.0
 	github.com/jawher/mow.cli v1.2.0
+	github.com/prometheus/client_golang v1.5.1
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	go.uber.org/zap v1.16.0
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v0.20.2
+	k8s.io/klog/v2 v2.4.0
 	sigs.k8s.io/sig-storage-lib-external-provisioner/v6 v6.2.0
+	sigs.k8s.io/yaml v1.2.0
 )
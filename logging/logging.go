@@ -0,0 +1,96 @@
+// Package logging sets up the structured logger shared by the provisioner packages
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// RequestVerbosity is the verbosity of FreeNAS API requests logging
+	RequestVerbosity = 1
+	// BodyVerbosity is the verbosity of FreeNAS API request and response bodies logging
+	BodyVerbosity = 2
+)
+
+var (
+	// Log is the root logger, text formatted at info level until Setup is called
+	Log logr.Logger
+
+	levels = map[string]zapcore.Level{
+		"info":  zapcore.InfoLevel,
+		"debug": zapcore.Level(-BodyVerbosity),
+	}
+)
+
+func init() {
+	Log, _ = newLogger("text", "info")
+}
+
+// Setup sets the format (json or text) and level (info or debug) of the root logger,
+// klog output (ie: of the Kubernetes libraries) is redirected to it
+func Setup(format, level string) error {
+	logger, err := newLogger(format, level)
+	if err != nil {
+		return err
+	}
+
+	Log = logger
+	klog.SetLogger(logger)
+
+	return nil
+}
+
+func newLogger(format, level string) (logr.Logger, error) {
+	zapLevel, ok := levels[level]
+	if !ok {
+		return nil, fmt.Errorf("Invalid log level \"%s\", must be info or debug", level)
+	}
+
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+	config.Sampling = nil
+	config.DisableStacktrace = true
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.EncoderConfig.EncodeLevel = levelEncoder(zapcore.LowercaseLevelEncoder)
+	switch format {
+	case "json":
+		config.Encoding = "json"
+	case "text":
+		config.Encoding = "console"
+		config.EncoderConfig.EncodeLevel = levelEncoder(zapcore.CapitalLevelEncoder)
+	default:
+		return nil, fmt.Errorf("Invalid log format \"%s\", must be json or text", format)
+	}
+
+	logger, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return zapr.NewLogger(logger), nil
+}
+
+// levelEncoder encodes the logr verbosity levels (ie: below zap debug level) as debug
+func levelEncoder(encoder zapcore.LevelEncoder) zapcore.LevelEncoder {
+	return func(level zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+		if level < zapcore.DebugLevel {
+			level = zapcore.DebugLevel
+		}
+		encoder(level, enc)
+	}
+}
+
+// NewRequestId returns a random id correlating the log lines of an operation
+func NewRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
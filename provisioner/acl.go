@@ -0,0 +1,99 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	aclTemplateConfigMapKey = "acl.json"
+)
+
+var (
+	// defaultAclTemplate grants full control to the owner and the group of the dataset
+	defaultAclTemplate = []freenas.AccessControlEntry{
+		{Principal: "owner@", Type: "ALLOW", Permissions: []string{"FULL_CONTROL"}, Inheritance: []string{"INHERIT"}},
+		{Principal: "group@", Type: "ALLOW", Permissions: []string{"FULL_CONTROL"}, Inheritance: []string{"INHERIT"}},
+	}
+)
+
+// ParseAclTemplate parses a JSON list of ACEs
+func ParseAclTemplate(str string) ([]freenas.AccessControlEntry, error) {
+	var template []freenas.AccessControlEntry
+	err := json.Unmarshal([]byte(str), &template)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ACL template: %v", err)
+	}
+
+	for _, ace := range template {
+		if err := ace.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return template, nil
+}
+
+// GetAclTemplate reads an ACL template from the acl.json key of a ConfigMap ("<namespace>/<name>")
+func (p *freenasProvisioner) GetAclTemplate(ctx context.Context, configMap string) ([]freenas.AccessControlEntry, error) {
+	nsName := strings.SplitN(configMap, "/", 2)
+	if len(nsName) != 2 {
+		return nil, fmt.Errorf("Invalid ACL template ConfigMap \"%s\", expected <namespace>/<name>", configMap)
+	}
+
+	cm, err := p.Client.CoreV1().ConfigMaps(nsName[0]).Get(ctx, nsName[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[aclTemplateConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap \"%s\" has no \"%s\" key", configMap, aclTemplateConfigMapKey)
+	}
+
+	return ParseAclTemplate(data)
+}
+
+// ExpandAclTemplate replaces ${var} references in principals
+// (e.g. group:${pvc.namespace}-rw) using the given variables
+func ExpandAclTemplate(template []freenas.AccessControlEntry, vars map[string]string) ([]freenas.AccessControlEntry, error) {
+	var missing []string
+	mapping := func(name string) string {
+		v, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	}
+
+	acl := make([]freenas.AccessControlEntry, 0, len(template))
+	for _, ace := range template {
+		ace.Principal = os.Expand(ace.Principal, mapping)
+		if err := ace.Validate(); err != nil {
+			return nil, err
+		}
+		acl = append(acl, ace)
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Unknown variable(s) %v in ACL template, available: %v", missing, aclTemplateVariables(vars))
+	}
+
+	return acl, nil
+}
+
+func aclTemplateVariables(vars map[string]string) []string {
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,300 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	storagev1alpha1 "k8s.io/api/storage/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	capacityIdentifierLabel = "freenas.org/identifier"
+)
+
+// CapacityPublisher periodically publishes the free space of the parent dataset
+// of each StorageClass backend as CSIStorageCapacity objects.
+// The scheduler only reads them for the provisioners having a CSIDriver object with
+// storageCapacity set and named after the provisioner, which the administrator creates
+// (no CSI driver runs, volumes are still mounted by the in-tree NFS plugin)
+type CapacityPublisher struct {
+	provisioner     *freenasProvisioner
+	provisionerName string
+	namespace       string
+	interval        time.Duration
+}
+
+func NewCapacityPublisher(client kubernetes.Interface, identifier string, recorder record.EventRecorder, provisionerName, namespace string, interval time.Duration) *CapacityPublisher {
+	return &CapacityPublisher{
+		provisioner:     newFreenasProvisioner(client, identifier, recorder),
+		provisionerName: provisionerName,
+		namespace:       namespace,
+		interval:        interval,
+	}
+}
+
+// Run publishes capacities until the context is done
+func (c *CapacityPublisher) Run(ctx context.Context) {
+	logging.Log.Info("Starting capacity publisher", "interval", c.interval.String(), "namespace", c.namespace)
+
+	c.checkDriver(ctx)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.publish(ctx)
+		if err != nil {
+			logging.Log.Error(err, "Cannot publish storage capacities")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDriver warns when the CSIDriver named after the provisioner, which has to be created
+// by the cluster administrator, is missing or does not enable storageCapacity
+func (c *CapacityPublisher) checkDriver(ctx context.Context) {
+	driver, err := c.provisioner.Client.StorageV1().CSIDrivers().Get(ctx, c.provisionerName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		logging.Log.Info("No CSIDriver named after the provisioner, storage capacities are ignored by the scheduler", "driver", c.provisionerName)
+	case err != nil:
+		logging.Log.Error(err, "Cannot get CSIDriver", "driver", c.provisionerName)
+	case driver.Spec.StorageCapacity == nil || !*driver.Spec.StorageCapacity:
+		logging.Log.Info("CSIDriver does not enable storageCapacity, storage capacities are ignored by the scheduler", "driver", c.provisionerName)
+	}
+}
+
+func (c *CapacityPublisher) publish(ctx context.Context) error {
+	client := c.provisioner.Client
+	classes, err := client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	published := map[string]bool{}
+	for _, class := range classes.Items {
+		if class.Provisioner != c.provisionerName {
+			continue
+		}
+
+		config, err := c.provisioner.GetConfig(ctx, class.Name)
+		if err != nil {
+			logging.Log.Error(err, "Cannot get capacity", "storageclass", class.Name)
+			continue
+		}
+
+		for _, secretName := range config.ServerSecretNames {
+			name := capacityName(class.Name, config.ServerSecretNamespace, secretName)
+			// keep the previous object if the backend is temporarily unavailable
+			published[name] = true
+
+			backendConfig, err := c.provisioner.GetBackendConfig(ctx, class.Name, secretName)
+			if err != nil {
+				logging.Log.Error(err, "Cannot get capacity", "storageclass", class.Name)
+				continue
+			}
+
+			capacity, err := c.provisioner.GetCapacity(backendConfig)
+			if err != nil {
+				logging.Log.Error(err, "Cannot get capacity", "storageclass", class.Name, "backend", backendConfig.ServerSecretName, "host", backendConfig.ServerHost)
+				continue
+			}
+
+			err = c.apply(ctx, &storagev1alpha1.CSIStorageCapacity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: c.namespace,
+					Labels: map[string]string{
+						capacityIdentifierLabel: c.provisioner.Identifier,
+					},
+				},
+				NodeTopology: &metav1.LabelSelector{
+					MatchLabels: backendConfig.ServerTopology,
+				},
+				StorageClassName: class.Name,
+				Capacity:         resource.NewQuantity(capacity, resource.BinarySI),
+			})
+			if err != nil {
+				logging.Log.Error(err, "Cannot publish capacity", "storageclass", class.Name)
+			}
+		}
+	}
+
+	// remove capacities of deleted classes / backends
+	capacities, err := client.StorageV1alpha1().CSIStorageCapacities(c.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", capacityIdentifierLabel, c.provisioner.Identifier),
+	})
+	if err != nil {
+		return err
+	}
+	for _, capacity := range capacities.Items {
+		if !published[capacity.Name] {
+			logging.Log.Info("Deleting stale storage capacity", "capacity", capacity.Name)
+			err = client.StorageV1alpha1().CSIStorageCapacities(c.namespace).Delete(ctx, capacity.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				logging.Log.Error(err, "Cannot delete stale storage capacity", "capacity", capacity.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CapacityPublisher) apply(ctx context.Context, capacity *storagev1alpha1.CSIStorageCapacity) error {
+	capacities := c.provisioner.Client.StorageV1alpha1().CSIStorageCapacities(c.namespace)
+	current, err := capacities.Get(ctx, capacity.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = capacities.Create(ctx, capacity, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.Capacity != nil && current.Capacity.Cmp(*capacity.Capacity) == 0 {
+		return nil
+	}
+
+	current.Capacity = capacity.Capacity
+	current.NodeTopology = capacity.NodeTopology
+	_, err = capacities.Update(ctx, current, metav1.UpdateOptions{})
+	return err
+}
+
+// GetCapacity returns the size of the largest volume a backend can provision
+// according to the parent dataset free space and quota, and the namespace quota
+func (p *freenasProvisioner) GetCapacity(config *freenasProvisionerConfig) (int64, error) {
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return 0, err
+	}
+
+	parentDs := freenas.Dataset{
+		Name: config.DatasetParentName,
+	}
+	err = parentDs.Get(freenasServer)
+	if err != nil {
+		return 0, err
+	}
+
+	capacity := parentDs.Avail
+	if parentDs.Quota > 0 && parentDs.Quota-parentDs.Used < capacity {
+		capacity = parentDs.Quota - parentDs.Used
+	}
+	if config.DatasetEnableNamespaces && config.DatasetNamespaceQuota > 0 && config.DatasetNamespaceQuota < capacity {
+		capacity = config.DatasetNamespaceQuota
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+
+	return capacity, nil
+}
+
+func capacityName(class, secretNamespace, secretName string) string {
+	return fmt.Sprintf("freenas-%x", sha256.Sum256([]byte(class+"/"+secretNamespace+"/"+secretName)))[:24]
+}
+
+// CheckCapacity returns an error describing the limit hit if a new dataset of the
+// given size cannot fit in the parent and namespace datasets
+func (p *freenasProvisioner) CheckCapacity(ctx context.Context, server *freenas.FreenasServer, config *freenasProvisionerConfig, parentDs *freenas.Dataset, nsDsName string, size int64) error {
+	if size > parentDs.Avail {
+		return fmt.Errorf("Requested size %s exceeds free space %s of parent dataset \"%s\"",
+			bytefmt.ByteSize(uint64(size)), bytefmt.ByteSize(uint64(parentDs.Avail)), parentDs.Name)
+	}
+
+	if config.DatasetEnableNamespaces && nsDsName != parentDs.Name {
+		nsDs := freenas.Dataset{Name: nsDsName}
+		if nsDs.Get(server) == nil {
+			if nsDs.Quota > 0 && size > nsDs.Quota-nsDs.Used {
+				return fmt.Errorf("Requested size %s exceeds remaining quota %s (quota: %s) of namespace dataset \"%s\"",
+					bytefmt.ByteSize(uint64(size)), bytefmt.ByteSize(uint64(max64(nsDs.Quota-nsDs.Used, 0))), bytefmt.ByteSize(uint64(nsDs.Quota)), nsDsName)
+			}
+		} else if config.DatasetNamespaceQuota > 0 && size > config.DatasetNamespaceQuota {
+			return fmt.Errorf("Requested size %s exceeds namespace quota %s (datasetNamespaceQuota)",
+				bytefmt.ByteSize(uint64(size)), bytefmt.ByteSize(uint64(config.DatasetNamespaceQuota)))
+		}
+	}
+
+	if config.MaxOverprovisionRatio > 0 {
+		children, err := parentDs.Children(server)
+		if err != nil {
+			return err
+		}
+
+		// datasets without refquota (quotas disabled) count for the capacity of their PV
+		volumeSizes, err := p.volumeSizes(ctx, config)
+		if err != nil {
+			return err
+		}
+
+		var provisioned int64 = 0
+		for _, child := range children {
+			if child.Refquota > 0 {
+				provisioned += child.Refquota
+			} else {
+				provisioned += volumeSizes[child.Name]
+			}
+		}
+
+		capacity := parentDs.Used + parentDs.Avail
+		if parentDs.Quota > 0 && parentDs.Quota < capacity {
+			capacity = parentDs.Quota
+		}
+
+		limit := int64(config.MaxOverprovisionRatio * float64(capacity))
+		if provisioned+size > limit {
+			return fmt.Errorf("Requested size %s would exceed maxOverprovisionRatio %g of parent dataset \"%s\" (provisioned: %s, limit: %s)",
+				bytefmt.ByteSize(uint64(size)), config.MaxOverprovisionRatio, parentDs.Name, bytefmt.ByteSize(uint64(provisioned)), bytefmt.ByteSize(uint64(limit)))
+		}
+	}
+
+	return nil
+}
+
+// volumeSizes returns the capacity of the PVs provisioned on the backend of config, by dataset name
+func (p *freenasProvisioner) volumeSizes(ctx context.Context, config *freenasProvisionerConfig) (map[string]int64, error) {
+	pvs, err := p.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, pv := range pvs.Items {
+		if pv.Annotations["freenasNFSProvisionerIdentity"] != p.Identifier || pv.Annotations["dataset"] == "" {
+			continue
+		}
+		// volumes provisioned before multiple backends have no backend annotation
+		if secretName := pv.Annotations["serverSecretName"]; secretName != "" && secretName != config.ServerSecretName {
+			continue
+		}
+
+		size := pv.Spec.Capacity[v1.ResourceStorage]
+		sizes[pv.Annotations["dataset"]] = size.Value()
+	}
+
+	return sizes, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
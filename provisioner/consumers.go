@@ -0,0 +1,304 @@
+package provisioner
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// NoConsumerHost is the only host allowed on a share when no pod is consuming it
+	NoConsumerHost = "127.0.0.1"
+
+	shareConsumersResyncPeriod = 30 * time.Second
+)
+
+// ShareConsumersController restricts the hosts allowed on NFS shares to the nodes
+// currently running pods which mount the corresponding PV
+type ShareConsumersController struct {
+	provisioner *freenasProvisioner
+	queue       workqueue.RateLimitingInterface
+
+	informerFactory informers.SharedInformerFactory
+	pvLister        corelisters.PersistentVolumeLister
+	pvcLister       corelisters.PersistentVolumeClaimLister
+	podLister       corelisters.PodLister
+	nodeLister      corelisters.NodeLister
+
+	// last time a host has been seen consuming a PV (pv name -> host -> time)
+	lastSeen map[string]map[string]time.Time
+	mutex    sync.Mutex
+}
+
+func NewShareConsumersController(client kubernetes.Interface, identifier string, recorder record.EventRecorder) *ShareConsumersController {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	// the configuration of every PV is read on each resync, from the informers' caches
+	provisioner := newFreenasProvisioner(client, identifier, recorder)
+	provisioner.classLister = factory.Storage().V1().StorageClasses().Lister()
+	provisioner.secretLister = factory.Core().V1().Secrets().Lister()
+
+	c := &ShareConsumersController{
+		provisioner:     provisioner,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "share-consumers"),
+		informerFactory: factory,
+		pvLister:        factory.Core().V1().PersistentVolumes().Lister(),
+		pvcLister:       factory.Core().V1().PersistentVolumeClaims().Lister(),
+		podLister:       factory.Core().V1().Pods().Lister(),
+		nodeLister:      factory.Core().V1().Nodes().Lister(),
+		lastSeen:        map[string]map[string]time.Time{},
+	}
+
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueuePod,
+		UpdateFunc: func(_, obj interface{}) { c.enqueuePod(obj) },
+		DeleteFunc: c.enqueuePod,
+	})
+	factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			if strings.Join(NodeAddresses(old.(*v1.Node)), " ") != strings.Join(NodeAddresses(obj.(*v1.Node)), " ") {
+				c.enqueueAll()
+			}
+		},
+	})
+	factory.Core().V1().PersistentVolumes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePV,
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pv, ok := obj.(*v1.PersistentVolume); ok {
+				c.mutex.Lock()
+				delete(c.lastSeen, pv.Name)
+				c.mutex.Unlock()
+			}
+		},
+	})
+	factory.Core().V1().PersistentVolumeClaims().Informer()
+	factory.Storage().V1().StorageClasses().Informer()
+	factory.Core().V1().Secrets().Informer()
+
+	return c
+}
+
+// Run starts watching pods and nodes until the context is done
+func (c *ShareConsumersController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	logging.Log.Info("Starting share consumers controller")
+	c.informerFactory.Start(ctx.Done())
+	c.informerFactory.WaitForCacheSync(ctx.Done())
+
+	go func() {
+		for c.processNextItem(ctx) {
+		}
+	}()
+
+	// periodic resync so that hosts are removed once their grace period is over
+	ticker := time.NewTicker(shareConsumersResyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.enqueueAll()
+		}
+	}
+}
+
+func (c *ShareConsumersController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.reconcile(ctx, key.(string))
+	if err != nil {
+		logging.Log.Error(err, "Cannot update allowed hosts", "pv", key)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *ShareConsumersController) enqueuePV(obj interface{}) {
+	if pv, ok := obj.(*v1.PersistentVolume); ok && c.isManaged(pv) {
+		c.queue.Add(pv.Name)
+	}
+}
+
+func (c *ShareConsumersController) enqueueAll() {
+	pvs, err := c.pvLister.List(labels.Everything())
+	if err != nil {
+		logging.Log.Error(err, "Cannot list PVs")
+		return
+	}
+
+	for _, pv := range pvs {
+		c.enqueuePV(pv)
+	}
+}
+
+func (c *ShareConsumersController) enqueuePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		pvc, err := c.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName)
+		if err != nil || pvc.Spec.VolumeName == "" {
+			continue
+		}
+
+		if pv, err := c.pvLister.Get(pvc.Spec.VolumeName); err == nil {
+			c.enqueuePV(pv)
+		}
+	}
+}
+
+// isManaged returns true if the PV has been provisioned by us with shareHostsFromConsumers enabled
+func (c *ShareConsumersController) isManaged(pv *v1.PersistentVolume) bool {
+	return pv.Annotations["freenasNFSProvisionerIdentity"] == c.provisioner.Identifier &&
+		pv.Annotations["shareHostsFromConsumers"] == "true" &&
+		pv.Spec.NFS != nil
+}
+
+func (c *ShareConsumersController) reconcile(ctx context.Context, pvName string) error {
+	pv, err := c.pvLister.Get(pvName)
+	if err != nil || !c.isManaged(pv) || pv.DeletionTimestamp != nil || pv.Status.Phase == v1.VolumeReleased {
+		return nil
+	}
+
+	config, err := c.provisioner.GetBackendConfig(ctx, pv.Spec.StorageClassName, pv.Annotations["serverSecretName"])
+	if err != nil {
+		return err
+	}
+
+	hosts, err := c.consumerHosts(pv, config.ShareConsumersGracePeriod)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		hosts = []string{NoConsumerHost}
+	}
+
+	freenasServer, err := c.provisioner.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	shareId, _ := strconv.Atoi(pv.Annotations["shareId"])
+	share := freenas.NfsShare{
+		Id:    shareId,
+		Paths: []string{pv.Spec.NFS.Path},
+	}
+	err = share.Get(freenasServer)
+	if err != nil {
+		return err
+	}
+
+	current := strings.Fields(share.Hosts)
+	sort.Strings(current)
+	if strings.Join(current, " ") == strings.Join(hosts, " ") && share.Network == "" {
+		return nil
+	}
+
+	logging.Log.Info("Updating allowed hosts of NFS share", "pv", pv.Name, "shareId", share.Id, "path", pv.Spec.NFS.Path, "from", share.Hosts, "to", strings.Join(hosts, " "))
+	share.Hosts = strings.Join(hosts, " ")
+	share.Network = ""
+	return c.provisioner.apply(logging.Log, config.DryRun, pv, share.UpdateRequest(), func() error { return share.Update(freenasServer) })
+}
+
+// consumerHosts returns the sorted addresses of the nodes running pods which mount the PV,
+// including the ones which stopped doing so within the grace period
+func (c *ShareConsumersController) consumerHosts(pv *v1.PersistentVolume, gracePeriod time.Duration) ([]string, error) {
+	now := time.Now()
+	seen := map[string]time.Time{}
+
+	if pv.Spec.ClaimRef != nil {
+		pods, err := c.podLister.Pods(pv.Spec.ClaimRef.Namespace).List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pod := range pods {
+			if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || !podUsesClaim(pod, pv.Spec.ClaimRef.Name) {
+				continue
+			}
+
+			node, err := c.nodeLister.Get(pod.Spec.NodeName)
+			if err != nil {
+				logging.Log.Error(err, "Cannot get node of pod", "node", pod.Spec.NodeName, "pod", pod.Name, "namespace", pod.Namespace)
+				continue
+			}
+
+			for _, host := range NodeAddresses(node) {
+				seen[host] = now
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for host, t := range c.lastSeen[pv.Name] {
+		if _, ok := seen[host]; !ok && now.Sub(t) < gracePeriod {
+			seen[host] = t
+		}
+	}
+	c.lastSeen[pv.Name] = seen
+
+	hosts := make([]string, 0, len(seen))
+	for host := range seen {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+func podUsesClaim(pod *v1.Pod, claimName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NodeAddresses returns the internal IP addresses of a node
+func NodeAddresses(node *v1.Node) []string {
+	var addresses []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP {
+			addresses = append(addresses, address.Address)
+		}
+	}
+
+	return addresses
+}
@@ -0,0 +1,162 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	doctorDatasetName = ".doctor"
+)
+
+// doctor prints the result of each step of a check
+type doctor struct {
+	out    io.Writer
+	failed bool
+}
+
+func (d *doctor) pass(name string, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "[PASS] %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(name string, err error) {
+	d.failed = true
+	fmt.Fprintf(d.out, "[FAIL] %s: %v\n", name, err)
+}
+
+// step prints the result of a step whose details do not depend on its success
+func (d *doctor) step(name string, err error, format string, args ...interface{}) bool {
+	if err != nil {
+		d.fail(name, err)
+		return false
+	}
+	d.pass(name, format, args...)
+	return true
+}
+
+// Doctor checks a StorageClass backend end to end: configuration, connection, parent dataset,
+// NFS service and a scratch dataset / share / permission cycle, returns false if a step failed
+func Doctor(ctx context.Context, client kubernetes.Interface, identifier string, recorder record.EventRecorder, storageClassName, secretName string, out io.Writer) bool {
+	p := newFreenasProvisioner(client, identifier, recorder)
+	d := &doctor{out: out}
+
+	class, err := client.StorageV1().StorageClasses().Get(ctx, storageClassName, metav1.GetOptions{})
+	if err != nil {
+		d.fail("storageclass", err)
+		return false
+	}
+	d.pass("storageclass", "provisioner %s", class.Provisioner)
+
+	config, err := p.GetBackendConfig(ctx, storageClassName, secretName)
+	if err != nil {
+		d.fail("config", err)
+		return false
+	}
+	d.pass("config", "secret %s/%s, server %s://%s:%d", config.ServerSecretNamespace, config.ServerSecretName, config.ServerProtocol, config.ServerHost, config.ServerPort)
+
+	freenasServer, err := p.GetServer(*config)
+	if !d.step("server", err, "client created") {
+		return false
+	}
+
+	version := freenas.Version{}
+	err = version.Get(freenasServer)
+	if !d.step("connection", err, "authenticated, version %s", version.FullVersion) {
+		return false
+	}
+
+	parentDs := freenas.Dataset{
+		Name: config.DatasetParentName,
+	}
+	err = parentDs.Get(freenasServer)
+	if !d.step("parent dataset", err, "%s (pool %s, %s free, mountpoint %s)", parentDs.Name, parentDs.Pool, bytefmt.ByteSize(uint64(parentDs.Avail)), parentDs.Mountpoint) {
+		return false
+	}
+
+	service := freenas.Service{Name: "nfs"}
+	err = service.Get(freenasServer)
+	if err == nil && !service.Running() {
+		err = errors.New(nfsServiceStopped)
+	}
+	if d.step("nfs service", err, "running") {
+		for _, msg := range p.checkNfsService(*class, config) {
+			fmt.Fprintf(out, "[WARN] nfs service: %s\n", msg)
+		}
+	}
+
+	d.scratch(freenasServer, config, &parentDs)
+
+	return !d.failed
+}
+
+// scratch runs a create, share, permission, get and delete cycle on a scratch dataset
+func (d *doctor) scratch(server *freenas.FreenasServer, config *freenasProvisionerConfig, parentDs *freenas.Dataset) {
+	path := filepath.Join(parentDs.Mountpoint, doctorDatasetName)
+	ds := freenas.Dataset{
+		Pool:     parentDs.Pool,
+		Name:     filepath.Join(parentDs.Name, doctorDatasetName),
+		Comments: "freenas-provisioner doctor",
+	}
+	share := freenas.NfsShare{
+		Paths:        []string{path},
+		Alldirs:      false,
+		Hosts:        NoConsumerHost,
+		MaprootUser:  config.ShareMaprootUser,
+		MaprootGroup: config.ShareMaprootGroup,
+		Comment:      "freenas-provisioner doctor",
+	}
+
+	// leftover of a previous run
+	if (&freenas.Dataset{Name: ds.Name}).Get(server) == nil {
+		if (&share).Get(server) == nil {
+			share.Delete(server)
+		}
+		err := ds.Delete(server)
+		if !d.step("cleanup", err, "deleted leftover dataset %s", ds.Name) {
+			return
+		}
+	}
+
+	err := ds.Create(server)
+	if !d.step("create dataset", err, "%s", ds.Name) {
+		return
+	}
+	defer func() {
+		err := ds.Delete(server)
+		d.step("delete dataset", err, "%s", ds.Name)
+	}()
+
+	err = share.Create(server)
+	if !d.step("create share", err, "%s (id %d)", path, share.Id) {
+		return
+	}
+	defer func() {
+		err := share.Delete(server)
+		d.step("delete share", err, "%s", path)
+	}()
+
+	permission := freenas.Permission{
+		Path:  path,
+		Acl:   "unix",
+		Mode:  config.DatasetPermissionsMode,
+		User:  config.DatasetPermissionsUser,
+		Group: config.DatasetPermissionsGroup,
+	}
+	err = permission.Put(server)
+	d.step("set permissions", err, "mode %s, owner %s:%s", permission.Mode, permission.User, permission.Group)
+
+	err = (&freenas.Dataset{Name: ds.Name}).Get(server)
+	d.step("get dataset", err, "%s", ds.Name)
+
+	err = (&freenas.NfsShare{Id: share.Id, Paths: share.Paths}).Get(server)
+	d.step("get share", err, "%s", path)
+}
@@ -0,0 +1,31 @@
+package provisioner
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var (
+	// ErrDryRun is returned by Provision and Delete once the changes they would have applied are logged
+	ErrDryRun = errors.New("dry run: changes have been logged but not applied on FreeNAS")
+)
+
+// apply runs a change on FreeNAS, in dry run mode the request it would send
+// is logged and recorded as an event of object instead
+func (p *freenasProvisioner) apply(log logr.Logger, dryRun bool, object runtime.Object, request freenas.Request, change func() error) error {
+	if !dryRun {
+		return change()
+	}
+
+	log.Info("Dry run", "method", request.Method, "endpoint", request.Endpoint, "body", request.Payload())
+	if object != nil && !reflect.ValueOf(object).IsNil() {
+		p.Recorder.Eventf(object, v1.EventTypeNormal, "DryRun", "%s", TruncateString("Dry run: "+request.String(), 1024))
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	encryptionKeySecretPrefix  = "freenas-key-"
+	defaultEncryptionAlgorithm = "AES-256-GCM"
+	// encryptionKeyLabel labels key Secrets with the identifier of the provisioner
+	encryptionKeyLabel = "freenas.org/encryption-key"
+)
+
+// encryptionKeySecretName returns the name of the Secret holding the key of a volume
+func encryptionKeySecretName(pvName string) string {
+	return encryptionKeySecretPrefix + pvName
+}
+
+// generateEncryption returns encryption options with a random key (or passphrase)
+func generateEncryption(algorithm, keyFormat string) (*freenas.DatasetEncryption, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption := &freenas.DatasetEncryption{
+		Algorithm: algorithm,
+	}
+	if keyFormat == "passphrase" {
+		encryption.Passphrase = base64.RawURLEncoding.EncodeToString(b)
+	} else {
+		encryption.Key = hex.EncodeToString(b)
+	}
+
+	return encryption, nil
+}
+
+// GetEncryptionKey returns the encryption options of a volume from its key Secret,
+// the Secret is created with a new key if it does not exist yet (created is then true)
+func (p *freenasProvisioner) GetEncryptionKey(ctx context.Context, config *freenasProvisionerConfig, pvName string) (*freenas.DatasetEncryption, bool, error) {
+	name := encryptionKeySecretName(pvName)
+	secret, err := p.Client.CoreV1().Secrets(config.DatasetEncryptionSecretNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return &freenas.DatasetEncryption{
+			Algorithm:  BytesToString(secret.Data["algorithm"]),
+			Passphrase: BytesToString(secret.Data["passphrase"]),
+			Key:        BytesToString(secret.Data["key"]),
+		}, false, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, false, err
+	}
+
+	encryption, err := generateEncryption(config.DatasetEncryptionAlgorithm, config.DatasetEncryptionKeyFormat)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// owner reference to the PV is set by the EncryptionKeyOwnerController once the PV exists
+	secret = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: config.DatasetEncryptionSecretNamespace,
+			Labels: map[string]string{
+				encryptionKeyLabel: p.Identifier,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"algorithm":  []byte(encryption.Algorithm),
+			"passphrase": []byte(encryption.Passphrase),
+			"key":        []byte(encryption.Key),
+		},
+	}
+	_, err = p.Client.CoreV1().Secrets(config.DatasetEncryptionSecretNamespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return encryption, true, nil
+}
+
+// setEncryptionKeyOwner makes the key Secret of a PV owned by it, keys of retained
+// volumes are left without owner as they must outlive their PV
+func (p *freenasProvisioner) setEncryptionKeyOwner(ctx context.Context, pv *v1.PersistentVolume) error {
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		return nil
+	}
+
+	namespace, name := pv.Annotations["encryptionKeySecretNamespace"], pv.Annotations["encryptionKeySecret"]
+	secret, err := p.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if len(secret.OwnerReferences) > 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "PersistentVolume",
+				Name:       pv.Name,
+				UID:        pv.UID,
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.Client.CoreV1().Secrets(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// DeleteEncryptionKey deletes the key Secret of a volume
+func (p *freenasProvisioner) DeleteEncryptionKey(ctx context.Context, log logr.Logger, namespace, name string) error {
+	err := p.Client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		log.Info("Could not find encryption key secret, already deleted?", "secret", name, "secretNamespace", namespace)
+		return nil
+	}
+	return err
+}
+
+// DatasetUnlocker periodically unlocks encrypted datasets locked after a server reboot
+type DatasetUnlocker struct {
+	provisioner *freenasProvisioner
+	interval    time.Duration
+}
+
+func NewDatasetUnlocker(client kubernetes.Interface, identifier string, recorder record.EventRecorder, interval time.Duration) *DatasetUnlocker {
+	return &DatasetUnlocker{
+		provisioner: newFreenasProvisioner(client, identifier, recorder),
+		interval:    interval,
+	}
+}
+
+// Run reconciles encrypted datasets until the context is done
+func (u *DatasetUnlocker) Run(ctx context.Context) {
+	logging.Log.Info("Starting dataset unlocker", "interval", u.interval.String())
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		err := u.reconcile(ctx)
+		if err != nil {
+			logging.Log.Error(err, "Cannot reconcile encrypted datasets")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *DatasetUnlocker) reconcile(ctx context.Context) error {
+	pvs, err := u.provisioner.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Annotations["freenasNFSProvisionerIdentity"] != u.provisioner.Identifier || pv.Annotations["encryptionKeySecret"] == "" {
+			continue
+		}
+
+		err = u.unlock(ctx, pv)
+		if err != nil {
+			logging.Log.Error(err, "Cannot reconcile encrypted dataset", "pv", pv.Name)
+		}
+	}
+
+	return nil
+}
+
+func (u *DatasetUnlocker) unlock(ctx context.Context, pv *v1.PersistentVolume) error {
+	namespace, name := pv.Annotations["encryptionKeySecretNamespace"], pv.Annotations["encryptionKeySecret"]
+	secret, err := u.provisioner.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	config, err := u.provisioner.GetBackendConfig(ctx, pv.Spec.StorageClassName, pv.Annotations["serverSecretName"])
+	if err != nil {
+		return err
+	}
+
+	freenasServer, err := u.provisioner.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	ds := freenas.Dataset{
+		Name: pv.Annotations["dataset"],
+	}
+	locked, err := ds.Locked(freenasServer)
+	if err != nil || !locked {
+		return err
+	}
+
+	freenasServer.Log.Info("Unlocking dataset", "pv", pv.Name, "dataset", ds.Name)
+	encryption := &freenas.DatasetEncryption{
+		Passphrase: BytesToString(secret.Data["passphrase"]),
+		Key:        BytesToString(secret.Data["key"]),
+	}
+	err = u.provisioner.apply(freenasServer.Log, config.DryRun, pv, ds.UnlockRequest(encryption), func() error {
+		_, err := ds.Unlock(freenasServer, encryption)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot unlock dataset \"%s\": %v", ds.Name, err)
+	}
+
+	return nil
+}
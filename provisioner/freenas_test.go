@@ -0,0 +1,220 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// fakeFreenas is an in-memory FreeNAS API serving the endpoints used to provision a volume
+type fakeFreenas struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	datasets map[string]map[string]interface{}
+	shares   map[int]map[string]interface{}
+	nextId   int
+	// requests are the method and path of the requests received
+	requests []string
+	// bodies are the request bodies received, by method and path
+	bodies map[string]string
+}
+
+func newFakeFreenas(t *testing.T) *fakeFreenas {
+	f := &fakeFreenas{
+		datasets: map[string]map[string]interface{}{
+			"tank": {"name": "tank", "pool": "tank", "mountpoint": "/mnt/tank", "avail": int64(1) << 40},
+		},
+		shares: map[int]map[string]interface{}{},
+		nextId: 1,
+		bodies: map[string]string{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeFreenas) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, key)
+	f.bodies[key] = string(body)
+
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		if v != nil {
+			json.NewEncoder(w).Encode(v)
+		}
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/api/v1.0/account/users/":
+		reply(200, []map[string]interface{}{
+			{"id": 1, "bsdusr_uid": 0, "bsdusr_username": "root"},
+			{"id": 2, "bsdusr_uid": 1000, "bsdusr_username": "app"},
+		})
+	case path == "/api/v1.0/account/groups/":
+		reply(200, []map[string]interface{}{
+			{"id": 1, "bsdgrp_gid": 0, "bsdgrp_group": "wheel"},
+			{"id": 2, "bsdgrp_gid": 1000, "bsdgrp_group": "app"},
+		})
+	case strings.HasPrefix(path, "/api/v1.0/storage/dataset/"):
+		name := strings.Trim(strings.TrimPrefix(path, "/api/v1.0/storage/dataset/"), "/")
+		switch r.Method {
+		case "GET":
+			if name == "" {
+				names := []string{}
+				for name := range f.datasets {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+				if offset > len(names) {
+					offset = len(names)
+				}
+				datasets := []map[string]interface{}{}
+				for _, name := range names[offset:] {
+					datasets = append(datasets, f.datasets[name])
+				}
+				reply(200, datasets)
+			} else if ds, ok := f.datasets[name]; ok {
+				reply(200, ds)
+			} else {
+				reply(404, map[string]string{"error": "not found"})
+			}
+		case "POST":
+			ds := map[string]interface{}{}
+			json.Unmarshal(body, &ds)
+			// sizes are sent as strings ("<n>b") but returned as numbers
+			for _, k := range []string{"quota", "reservation", "refquota", "refreservation"} {
+				if v, ok := ds[k].(string); ok {
+					ds[k], _ = strconv.ParseInt(strings.TrimSuffix(v, "b"), 10, 64)
+				}
+			}
+			ds["name"] = name + "/" + ds["name"].(string)
+			ds["mountpoint"] = "/mnt/" + ds["name"].(string)
+			f.datasets[ds["name"].(string)] = ds
+			reply(201, ds)
+		case "DELETE":
+			delete(f.datasets, name)
+			reply(204, nil)
+		}
+	case path == "/api/v1.0/sharing/nfs/":
+		switch r.Method {
+		case "GET":
+			shares := []map[string]interface{}{}
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			for id := 1; id < f.nextId; id++ {
+				if share, ok := f.shares[id]; ok {
+					shares = append(shares, share)
+				}
+			}
+			if offset > len(shares) {
+				offset = len(shares)
+			}
+			reply(200, shares[offset:])
+		case "POST":
+			share := map[string]interface{}{}
+			json.Unmarshal(body, &share)
+			share["id"] = f.nextId
+			f.shares[f.nextId] = share
+			f.nextId++
+			reply(201, share)
+		}
+	case strings.HasPrefix(path, "/api/v1.0/sharing/nfs/"):
+		id, _ := strconv.Atoi(strings.Trim(strings.TrimPrefix(path, "/api/v1.0/sharing/nfs/"), "/"))
+		share, ok := f.shares[id]
+		switch {
+		case !ok:
+			reply(404, map[string]string{"error": "not found"})
+		case r.Method == "GET":
+			reply(200, share)
+		case r.Method == "DELETE":
+			delete(f.shares, id)
+			reply(204, nil)
+		}
+	case path == "/api/v2.0/sharing/nfs":
+		reply(422, map[string]string{"path": "unknown field"})
+	case path == "/api/v1.0/storage/permission/":
+		reply(201, nil)
+	case path == "/api/v2.0/filesystem/setperm":
+		reply(200, 1)
+	default:
+		reply(404, map[string]string{"error": "unexpected " + key})
+	}
+}
+
+// newFakeCluster returns a client holding a StorageClass "freenas" (with parameters)
+// whose backend Secret points to server
+func newFakeCluster(t *testing.T, server *httptest.Server, parameters map[string]string) *fake.Clientset {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	return fake.NewSimpleClientset(
+		&storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "freenas"},
+			Provisioner:   "freenas.org/nfs",
+			Parameters:    parameters,
+			ReclaimPolicy: &reclaimPolicy,
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "freenas-nfs", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"protocol": []byte("http"),
+				"host":     []byte(host),
+				"port":     []byte(port),
+				"password": []byte("secret"),
+			},
+		},
+	)
+}
+
+// provisionOptions returns the options to provision a 1Gi volume pvc-<name> for claim default/<name>
+func provisionOptions(client *fake.Clientset, name string) controller.ProvisionOptions {
+	class, _ := client.StorageV1().StorageClasses().Get(context.Background(), "freenas", metav1.GetOptions{})
+	className := class.Name
+	return controller.ProvisionOptions{
+		StorageClass: class,
+		PVName:       fmt.Sprintf("pvc-%s", name),
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &className,
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		},
+	}
+}
+
+// newTestProvisioner returns a provisioner of client dropping its events
+func newTestProvisioner(client *fake.Clientset) *freenasProvisioner {
+	return newFreenasProvisioner(client, "test", &record.FakeRecorder{})
+}
@@ -0,0 +1,238 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	backendCheckInterval = 30 * time.Second
+)
+
+// BackendStatus is the result of the last check of a StorageClass backend
+type BackendStatus struct {
+	StorageClass  string    `json:"storageClass"`
+	Secret        string    `json:"secret"`
+	Host          string    `json:"host"`
+	Version       string    `json:"version,omitempty"`
+	Latency       string    `json:"latency,omitempty"`
+	ParentDataset string    `json:"parentDataset,omitempty"`
+	ParentAvail   int64     `json:"parentAvail"`
+	LastCheck     time.Time `json:"lastCheck"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+// HealthServer serves the /healthz, /readyz and /debug/backends endpoints
+type HealthServer struct {
+	provisioner     *freenasProvisioner
+	provisionerName string
+	port            int
+
+	// fails once the leader has not renewed its lease in time
+	watchdog *leaderelection.HealthzAdaptor
+
+	mu       sync.Mutex
+	backends []BackendStatus
+	checked  bool
+	checking bool
+}
+
+// NewHealthServer returns a health server, alive unless this replica is the leader and failed
+// to renew its lease (the leader election loop being wedged) and ready once the backends answer
+func NewHealthServer(client kubernetes.Interface, identifier string, recorder record.EventRecorder, provisionerName string, port int, watchdog *leaderelection.HealthzAdaptor) *HealthServer {
+	return &HealthServer{
+		provisioner:     newFreenasProvisioner(client, identifier, recorder),
+		provisionerName: provisionerName,
+		port:            port,
+		watchdog:        watchdog,
+	}
+}
+
+// Run checks backends and serves the endpoints until the context is done
+func (h *HealthServer) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/debug/backends", h.debugBackends)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", h.port),
+		Handler: mux,
+	}
+
+	go func() {
+		logging.Log.Info("Starting health server", "port", h.port)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logging.Log.Error(err, "Health server failed")
+		}
+	}()
+
+	ticker := time.NewTicker(backendCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		h.startCheck(ctx)
+
+		select {
+		case <-ctx.Done():
+			server.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startCheck starts a backend check unless one is still running,
+// so slow or unreachable backends do not pile up checks
+func (h *HealthServer) startCheck(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.checking {
+		return
+	}
+	h.checking = true
+	go func() {
+		h.check(ctx)
+		h.mu.Lock()
+		h.checking = false
+		h.mu.Unlock()
+	}()
+}
+
+// check checks every backend of the StorageClasses of the provisioner
+func (h *HealthServer) check(ctx context.Context) {
+	classes, err := h.provisioner.Client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logging.Log.Error(err, "Cannot check backends, unable to list StorageClasses")
+		return
+	}
+
+	var backends []BackendStatus
+	for _, class := range classes.Items {
+		if class.Provisioner != h.provisionerName {
+			continue
+		}
+
+		config, err := h.provisioner.GetConfig(ctx, class.Name)
+		if err != nil {
+			backends = append(backends, BackendStatus{
+				StorageClass: class.Name,
+				LastCheck:    time.Now(),
+				LastError:    err.Error(),
+			})
+			continue
+		}
+
+		for _, secretName := range config.ServerSecretNames {
+			backends = append(backends, h.checkBackend(ctx, class.Name, secretName))
+		}
+	}
+
+	h.mu.Lock()
+	h.backends = backends
+	h.checked = true
+	h.mu.Unlock()
+}
+
+func (h *HealthServer) checkBackend(ctx context.Context, storageClassName, secretName string) BackendStatus {
+	status := BackendStatus{
+		StorageClass: storageClassName,
+		Secret:       secretName,
+		LastCheck:    time.Now(),
+	}
+
+	config, err := h.provisioner.GetBackendConfig(ctx, storageClassName, secretName)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	status.Host = config.ServerHost
+	status.ParentDataset = config.DatasetParentName
+
+	freenasServer, err := h.provisioner.GetServer(*config)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+
+	// authenticated call
+	start := time.Now()
+	version := freenas.Version{}
+	err = version.Get(freenasServer)
+	status.Latency = time.Since(start).String()
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	status.Version = version.FullVersion
+
+	parentDs := freenas.Dataset{
+		Name: config.DatasetParentName,
+	}
+	err = parentDs.Get(freenasServer)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	status.ParentAvail = parentDs.Avail
+
+	return status
+}
+
+func (h *HealthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	err := h.watchdog.Check(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *HealthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	_, err := h.provisioner.Client.Discovery().ServerVersion()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("kubernetes API is not reachable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.checked {
+		http.Error(w, "backends have not been checked yet", http.StatusServiceUnavailable)
+		return
+	}
+	for _, backend := range h.backends {
+		if backend.LastError != "" {
+			http.Error(w, fmt.Sprintf("StorageClass \"%s\", backend \"%s\": %s", backend.StorageClass, backend.Secret, backend.LastError), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *HealthServer) debugBackends(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	backends := h.backends
+	h.mu.Unlock()
+
+	if backends == nil {
+		backends = []BackendStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(backends)
+}
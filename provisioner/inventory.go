@@ -0,0 +1,289 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// Inventory is the list of the volumes of a provisioner, used to recreate them in a new cluster
+type Inventory struct {
+	Identifier string            `json:"identifier"`
+	Volumes    []InventoryVolume `json:"volumes"`
+}
+
+// InventoryVolume holds what is needed to recreate a PersistentVolume (and its claim)
+type InventoryVolume struct {
+	Name          string                           `json:"name"`
+	StorageClass  string                           `json:"storageClass"`
+	Annotations   map[string]string                `json:"annotations,omitempty"`
+	Labels        map[string]string                `json:"labels,omitempty"`
+	Capacity      resource.Quantity                `json:"capacity"`
+	AccessModes   []v1.PersistentVolumeAccessMode  `json:"accessModes,omitempty"`
+	ReclaimPolicy v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	MountOptions  []string                         `json:"mountOptions,omitempty"`
+	NodeAffinity  *v1.VolumeNodeAffinity           `json:"nodeAffinity,omitempty"`
+	NFS           *v1.NFSVolumeSource              `json:"nfs"`
+	ClaimRef      *v1.ObjectReference              `json:"claimRef,omitempty"`
+	// data of the encryption key Secret of encrypted datasets
+	EncryptionKey map[string][]byte `json:"encryptionKey,omitempty"`
+}
+
+// ExportInventory returns the inventory of the PVs provisioned with identifier
+func ExportInventory(ctx context.Context, client kubernetes.Interface, identifier string) (*Inventory, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &Inventory{
+		Identifier: identifier,
+		Volumes:    []InventoryVolume{},
+	}
+	for _, pv := range pvs.Items {
+		if pv.Annotations["freenasNFSProvisionerIdentity"] != identifier || pv.Spec.NFS == nil {
+			continue
+		}
+
+		volume := InventoryVolume{
+			Name:          pv.Name,
+			StorageClass:  pv.Spec.StorageClassName,
+			Annotations:   pv.Annotations,
+			Labels:        pv.Labels,
+			Capacity:      pv.Spec.Capacity[v1.ResourceStorage],
+			AccessModes:   pv.Spec.AccessModes,
+			ReclaimPolicy: pv.Spec.PersistentVolumeReclaimPolicy,
+			MountOptions:  pv.Spec.MountOptions,
+			NodeAffinity:  pv.Spec.NodeAffinity,
+			NFS:           pv.Spec.NFS,
+		}
+		if claim := pv.Spec.ClaimRef; claim != nil {
+			volume.ClaimRef = &v1.ObjectReference{
+				Kind:       claim.Kind,
+				APIVersion: claim.APIVersion,
+				Namespace:  claim.Namespace,
+				Name:       claim.Name,
+			}
+		}
+		// without its key, an encrypted dataset cannot be unlocked in the new cluster
+		if name := pv.Annotations["encryptionKeySecret"]; name != "" {
+			namespace := pv.Annotations["encryptionKeySecretNamespace"]
+			secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("Cannot get encryption key secret %s/%s of %s: %v", namespace, name, pv.Name, err)
+			}
+			volume.EncryptionKey = secret.Data
+		}
+		inventory.Volumes = append(inventory.Volumes, volume)
+	}
+
+	return inventory, nil
+}
+
+// RestoreInventory recreates the PVs of an inventory (and their claims if claims is set)
+// whose dataset and share still exist, returns false if a volume could not be restored
+func RestoreInventory(ctx context.Context, client kubernetes.Interface, identifier string, recorder record.EventRecorder, inventory *Inventory, claims bool, out io.Writer) bool {
+	p := newFreenasProvisioner(client, identifier, recorder)
+	d := &doctor{out: out}
+
+	if inventory.Identifier != identifier {
+		d.fail("inventory", fmt.Errorf("Inventory has been exported with identifier \"%s\", not \"%s\"", inventory.Identifier, identifier))
+		return false
+	}
+
+	for _, volume := range inventory.Volumes {
+		err := p.restoreVolume(ctx, volume, claims)
+		if err != nil {
+			d.fail(volume.Name, err)
+			continue
+		}
+
+		if claims && volume.ClaimRef != nil {
+			d.pass(volume.Name, "restored, bound to claim %s/%s", volume.ClaimRef.Namespace, volume.ClaimRef.Name)
+		} else {
+			d.pass(volume.Name, "restored")
+		}
+	}
+
+	return !d.failed
+}
+
+func (p *freenasProvisioner) restoreVolume(ctx context.Context, volume InventoryVolume, claims bool) error {
+	if volume.NFS == nil {
+		return fmt.Errorf("No NFS source")
+	}
+
+	_, err := p.Client.CoreV1().PersistentVolumes().Get(ctx, volume.Name, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("PersistentVolume already exists")
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	err = p.checkVolume(ctx, volume)
+	if err != nil {
+		return err
+	}
+
+	keyNamespace, keyName := volume.Annotations["encryptionKeySecretNamespace"], volume.Annotations["encryptionKeySecret"]
+	restoreKey := false
+	if keyName != "" {
+		_, err = p.Client.CoreV1().Secrets(keyNamespace).Get(ctx, keyName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if volume.EncryptionKey == nil {
+				return fmt.Errorf("Encrypted dataset and no encryption key in the inventory nor secret %s/%s", keyNamespace, keyName)
+			}
+			restoreKey = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        volume.Name,
+			Annotations: volume.Annotations,
+			Labels:      volume.Labels,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName:              volume.StorageClass,
+			PersistentVolumeReclaimPolicy: volume.ReclaimPolicy,
+			NodeAffinity:                  volume.NodeAffinity,
+			AccessModes:                   volume.AccessModes,
+			MountOptions:                  volume.MountOptions,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: volume.Capacity,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: volume.NFS,
+			},
+		},
+	}
+	// pre-bound to its claim (whose uid has changed)
+	if volume.ClaimRef != nil {
+		pv.Spec.ClaimRef = volume.ClaimRef.DeepCopy()
+	}
+
+	pv, err = p.Client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if restoreKey {
+		err = p.restoreEncryptionKey(ctx, pv, volume.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("PersistentVolume restored but its encryption key secret could not be created: %v", err)
+		}
+	}
+
+	if !claims || volume.ClaimRef == nil {
+		return nil
+	}
+
+	_, err = p.Client.CoreV1().PersistentVolumeClaims(volume.ClaimRef.Namespace).Get(ctx, volume.ClaimRef.Name, metav1.GetOptions{})
+	if err == nil {
+		// bound by the PV controller if it matches
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	storageClass := volume.StorageClass
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      volume.ClaimRef.Name,
+			Namespace: volume.ClaimRef.Namespace,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			AccessModes:      volume.AccessModes,
+			VolumeName:       volume.Name,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: volume.Capacity,
+				},
+			},
+		},
+	}
+	_, err = p.Client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("PersistentVolume restored but its claim could not be created: %v", err)
+	}
+
+	return nil
+}
+
+// restoreEncryptionKey recreates the key Secret of a restored PV, owned by it unless retained
+func (p *freenasProvisioner) restoreEncryptionKey(ctx context.Context, pv *v1.PersistentVolume, data map[string][]byte) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pv.Annotations["encryptionKeySecret"],
+			Namespace: pv.Annotations["encryptionKeySecretNamespace"],
+			Labels: map[string]string{
+				encryptionKeyLabel: p.Identifier,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: data,
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "PersistentVolume",
+			Name:       pv.Name,
+			UID:        pv.UID,
+		}}
+	}
+
+	_, err := p.Client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
+
+// checkVolume checks the dataset and share of a volume still exist on its backend
+func (p *freenasProvisioner) checkVolume(ctx context.Context, volume InventoryVolume) error {
+	config, err := p.GetBackendConfig(ctx, volume.StorageClass, volume.Annotations["serverSecretName"])
+	if err != nil {
+		return err
+	}
+
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	ds := freenas.Dataset{
+		Name: volume.Annotations["dataset"],
+	}
+	err = ds.Get(freenasServer)
+	if err != nil {
+		return fmt.Errorf("Cannot find dataset \"%s\": %v", ds.Name, err)
+	}
+
+	shareId, _ := strconv.Atoi(volume.Annotations["shareId"])
+	share := freenas.NfsShare{
+		Id:    shareId,
+		Paths: []string{volume.NFS.Path},
+	}
+	err = share.Get(freenasServer)
+	if err != nil {
+		return fmt.Errorf("Cannot find NFS share \"%s\": %v", volume.NFS.Path, err)
+	}
+	for _, path := range share.Paths {
+		if path == volume.NFS.Path {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("NFS share %d does not export \"%s\" (%v)", shareId, volume.NFS.Path, share.Paths)
+}
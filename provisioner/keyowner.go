@@ -0,0 +1,96 @@
+package provisioner
+
+import (
+	"context"
+
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// EncryptionKeyOwnerController makes the key Secrets of encrypted volumes owned by their PV
+// once the provision controller has created it (unless the PV is retained)
+type EncryptionKeyOwnerController struct {
+	provisioner *freenasProvisioner
+	queue       workqueue.RateLimitingInterface
+
+	informerFactory informers.SharedInformerFactory
+	pvLister        corelisters.PersistentVolumeLister
+}
+
+func NewEncryptionKeyOwnerController(client kubernetes.Interface, identifier string, recorder record.EventRecorder) *EncryptionKeyOwnerController {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c := &EncryptionKeyOwnerController{
+		provisioner:     newFreenasProvisioner(client, identifier, recorder),
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "encryption-key-owner"),
+		informerFactory: factory,
+		pvLister:        factory.Core().V1().PersistentVolumes().Lister(),
+	}
+
+	factory.Core().V1().PersistentVolumes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueuePV,
+		// only a reclaim policy switched to Delete needs an owner afterwards
+		UpdateFunc: func(old, obj interface{}) {
+			if old.(*v1.PersistentVolume).Spec.PersistentVolumeReclaimPolicy != obj.(*v1.PersistentVolume).Spec.PersistentVolumeReclaimPolicy {
+				c.enqueuePV(obj)
+			}
+		},
+	})
+
+	return c
+}
+
+// Run watches PVs until the context is done
+func (c *EncryptionKeyOwnerController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	logging.Log.Info("Starting encryption key owner controller")
+	c.informerFactory.Start(ctx.Done())
+	c.informerFactory.WaitForCacheSync(ctx.Done())
+
+	go func() {
+		for c.processNextItem(ctx) {
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+func (c *EncryptionKeyOwnerController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	pv, err := c.pvLister.Get(key.(string))
+	if err != nil || pv.DeletionTimestamp != nil {
+		// deleted since
+		c.queue.Forget(key)
+		return true
+	}
+
+	err = c.provisioner.setEncryptionKeyOwner(ctx, pv)
+	if err != nil {
+		logging.Log.Error(err, "Cannot set owner of encryption key secret", "pv", key)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *EncryptionKeyOwnerController) enqueuePV(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if ok && pv.Annotations["freenasNFSProvisionerIdentity"] == c.provisioner.Identifier &&
+		pv.Annotations["encryptionKeySecret"] != "" &&
+		pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		c.queue.Add(pv.Name)
+	}
+}
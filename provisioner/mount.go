@@ -0,0 +1,51 @@
+package provisioner
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	kerberosNfsVersion = "4.1"
+)
+
+// ShareMountOptions merges the mount options of a StorageClass with the ones
+// required by the NFS security flavor of the share
+func ShareMountOptions(security string, classMountOptions []string) ([]string, error) {
+	mountOptions := append([]string{}, classMountOptions...)
+	if !strings.HasPrefix(security, "krb5") {
+		return mountOptions, nil
+	}
+
+	if sec, ok := MountOption(classMountOptions, "sec"); !ok {
+		mountOptions = append(mountOptions, "sec="+security)
+	} else if sec != security {
+		return nil, fmt.Errorf("Mount option \"sec=%s\" conflicts with shareSecurity \"%s\"", sec, security)
+	}
+
+	if version, ok := MountOption(classMountOptions, "vers", "nfsvers"); !ok {
+		mountOptions = append(mountOptions, "vers="+kerberosNfsVersion)
+	} else if !strings.HasPrefix(version, "4") {
+		return nil, fmt.Errorf("Mount option \"vers=%s\" conflicts with shareSecurity \"%s\" which requires NFSv4", version, security)
+	}
+
+	return mountOptions, nil
+}
+
+// MountOption returns the value of the first mount option matching one of the given names
+func MountOption(mountOptions []string, names ...string) (string, bool) {
+	for _, mountOption := range mountOptions {
+		for _, option := range strings.Split(mountOption, ",") {
+			kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+			if !containsString(names, kv[0]) {
+				continue
+			}
+			if len(kv) == 1 {
+				return "", true
+			}
+			return kv[1], true
+		}
+	}
+
+	return "", false
+}
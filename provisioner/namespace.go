@@ -0,0 +1,161 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// namespaceDatasetComments identifies the namespace datasets created by the provisioner
+	namespaceDatasetComments = "k8s provisioned namespace"
+)
+
+// CleanupNamespaceDataset destroys a namespace dataset if it has been created
+// by the provisioner and has no child dataset left, in dry run mode the deletion
+// is only logged (and recorded as an event of object)
+func (p *freenasProvisioner) CleanupNamespaceDataset(server *freenas.FreenasServer, name string, dryRun bool, object runtime.Object) error {
+	nsDs := freenas.Dataset{
+		Name: name,
+	}
+	if nsDs.Get(server) != nil {
+		// already deleted
+		return nil
+	}
+
+	if nsDs.Comments != namespaceDatasetComments {
+		server.Log.Info("Namespace dataset has not been created by the provisioner, retaining it", "dataset", name)
+		return nil
+	}
+
+	children, err := nsDs.Children(server)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return nil
+	}
+
+	server.Log.Info("Deleting empty namespace dataset", "dataset", name)
+	return p.apply(server.Log, dryRun, object, nsDs.DeleteRequest(), func() error { return nsDs.Delete(server) })
+}
+
+// NamespaceCleanupController destroys the empty namespace datasets of deleted namespaces
+type NamespaceCleanupController struct {
+	provisioner     *freenasProvisioner
+	provisionerName string
+	queue           workqueue.RateLimitingInterface
+	informerFactory informers.SharedInformerFactory
+}
+
+func NewNamespaceCleanupController(client kubernetes.Interface, identifier string, recorder record.EventRecorder, provisionerName string) *NamespaceCleanupController {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c := &NamespaceCleanupController{
+		provisioner:     newFreenasProvisioner(client, identifier, recorder),
+		provisionerName: provisionerName,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "namespace-cleanup"),
+		informerFactory: factory,
+	}
+
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ns, ok := obj.(*v1.Namespace); ok {
+				c.queue.Add(ns.Name)
+			}
+		},
+	})
+
+	return c
+}
+
+// Run watches namespaces until the context is done
+func (c *NamespaceCleanupController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	logging.Log.Info("Starting namespace cleanup controller")
+	c.informerFactory.Start(ctx.Done())
+	c.informerFactory.WaitForCacheSync(ctx.Done())
+
+	go func() {
+		for c.processNextItem(ctx) {
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+func (c *NamespaceCleanupController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.cleanup(ctx, key.(string))
+	if err != nil {
+		logging.Log.Error(err, "Cannot cleanup datasets of namespace", "namespace", key)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *NamespaceCleanupController) cleanup(ctx context.Context, namespace string) error {
+	classes, err := c.provisioner.Client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		if class.Provisioner != c.provisionerName {
+			continue
+		}
+
+		config, err := c.provisioner.GetConfig(ctx, class.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !config.DatasetEnableNamespaces || config.DatasetRetainNamespaces {
+			continue
+		}
+
+		for _, secretName := range config.ServerSecretNames {
+			backendConfig, err := c.provisioner.GetBackendConfig(ctx, class.Name, secretName)
+			if err == nil {
+				var freenasServer *freenas.FreenasServer
+				freenasServer, err = c.provisioner.GetServer(*backendConfig)
+				if err == nil {
+					err = c.provisioner.CleanupNamespaceDataset(freenasServer, filepath.Join(backendConfig.DatasetParentName, namespace), backendConfig.DryRun, class)
+				}
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	UidAnnotation = "freenas.org/uid"
+	GidAnnotation = "freenas.org/gid"
+
+	openshiftUidRangeAnnotation           = "openshift.io/sa.scc.uid-range"
+	openshiftSupplementalGroupsAnnotation = "openshift.io/sa.scc.supplemental-groups"
+)
+
+// GetOwner returns the numeric owner (uid, gid) of a claim's dataset taken from
+// the claim annotations, then the namespace ones (including OpenShift SCC ranges)
+// Empty values are returned if no owner is found
+func (p *freenasProvisioner) GetOwner(ctx context.Context, pvc *v1.PersistentVolumeClaim) (string, string, error) {
+	uid, err := annotationId(pvc.Annotations, UidAnnotation)
+	if err != nil {
+		return "", "", err
+	}
+	gid, err := annotationId(pvc.Annotations, GidAnnotation)
+	if err != nil {
+		return "", "", err
+	}
+	if uid != "" && gid != "" {
+		return uid, gid, nil
+	}
+
+	ns, err := p.Client.CoreV1().Namespaces().Get(ctx, pvc.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	if uid == "" {
+		uid, err = annotationId(ns.Annotations, UidAnnotation)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if uid == "" {
+		uid, err = annotationRangeStart(ns.Annotations, openshiftUidRangeAnnotation)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if gid == "" {
+		gid, err = annotationId(ns.Annotations, GidAnnotation)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if gid == "" {
+		gid, err = annotationRangeStart(ns.Annotations, openshiftSupplementalGroupsAnnotation)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	// use the uid as primary group as OpenShift does when no group is found
+	if gid == "" {
+		gid = uid
+	}
+
+	return uid, gid, nil
+}
+
+// annotationId returns the numeric id of an annotation
+func annotationId(annotations map[string]string, key string) (string, error) {
+	v, ok := annotations[key]
+	if !ok {
+		return "", nil
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("Invalid annotation %s=\"%s\", must be a numeric id", key, v)
+	}
+
+	return strconv.FormatUint(id, 10), nil
+}
+
+// annotationRangeStart returns the first id of an OpenShift range annotation
+// formatted as <start>/<size> or <start>-<end> (several ranges are comma-separated)
+func annotationRangeStart(annotations map[string]string, key string) (string, error) {
+	v, ok := annotations[key]
+	if !ok {
+		return "", nil
+	}
+
+	start := strings.FieldsFunc(v, func(r rune) bool {
+		return r == '/' || r == '-' || r == ','
+	})
+	if len(start) == 0 {
+		return "", fmt.Errorf("Invalid annotation %s=\"%s\"", key, v)
+	}
+
+	return annotationId(map[string]string{key: start[0]}, key)
+}
+
+// ownerNames returns the names of the user and group of a numeric owner, as the v1 share API
+// only maps requests to account names
+func ownerNames(server *freenas.FreenasServer, uid, gid string) (string, string, error) {
+	users, err := freenas.ListUsers(server)
+	if err != nil {
+		return "", "", err
+	}
+	user := ""
+	for _, u := range users {
+		if strconv.Itoa(u.Uid) == uid {
+			user = u.Username
+			break
+		}
+	}
+	if user == "" {
+		return "", "", fmt.Errorf("No user with uid %s on server \"%s\", cannot map all share access to the owner (shareMapallToOwner)", uid, server.Host)
+	}
+
+	groups, err := freenas.ListGroups(server)
+	if err != nil {
+		return "", "", err
+	}
+	group := ""
+	for _, g := range groups {
+		if strconv.Itoa(g.Gid) == gid {
+			group = g.Name
+			break
+		}
+	}
+	if group == "" {
+		return "", "", fmt.Errorf("No group with gid %s on server \"%s\", cannot map all share access to the owner (shareMapallToOwner)", gid, server.Host)
+	}
+
+	return user, group, nil
+}
@@ -0,0 +1,41 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestShareMapallToOwner(t *testing.T) {
+	nas := newFakeFreenas(t)
+	client := newFakeCluster(t, nas.Server, map[string]string{
+		"datasetParentName":           "tank",
+		"datasetOwnerFromAnnotations": "true",
+		"shareMapallToOwner":          "true",
+	})
+	p := newTestProvisioner(client)
+
+	options := provisionOptions(client, "data")
+	options.PVC.Annotations = map[string]string{UidAnnotation: "1000", GidAnnotation: "1000"}
+	_, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := map[string]interface{}{}
+	json.Unmarshal([]byte(nas.bodies["POST /api/v1.0/sharing/nfs/"]), &share)
+	if share["nfs_mapall_user"] != "app" || share["nfs_mapall_group"] != "app" {
+		t.Errorf("expected share access mapped to app:app, got %v:%v", share["nfs_mapall_user"], share["nfs_mapall_group"])
+	}
+	if _, ok := share["nfs_maproot_user"]; ok {
+		t.Errorf("expected no maproot user, got %v", share["nfs_maproot_user"])
+	}
+
+	options = provisionOptions(client, "unknown")
+	options.PVC.Annotations = map[string]string{UidAnnotation: "2000", GidAnnotation: "1000"}
+	_, _, err = p.Provision(context.Background(), options)
+	if err == nil || !strings.Contains(err.Error(), "No user with uid 2000") {
+		t.Errorf("expected an unknown uid error, got %v", err)
+	}
+}
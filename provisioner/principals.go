@@ -0,0 +1,136 @@
+package provisioner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+)
+
+const (
+	principalFullName = "k8s provisioned service user"
+)
+
+// principals are the user and group names referenced by a volume
+type principals struct {
+	users  map[string]bool
+	groups map[string]bool
+}
+
+func newPrincipals() *principals {
+	return &principals{
+		users:  map[string]bool{},
+		groups: map[string]bool{},
+	}
+}
+
+// addUser references a user name, numeric ids and empty names are ignored
+func (p *principals) addUser(name string) {
+	if _, err := strconv.Atoi(name); name != "" && err != nil {
+		p.users[name] = true
+	}
+}
+
+// addGroup references a group name, numeric ids and empty names are ignored
+func (p *principals) addGroup(name string) {
+	if _, err := strconv.Atoi(name); name != "" && err != nil {
+		p.groups[name] = true
+	}
+}
+
+// addAcl references the named users and groups of an ACL
+func (p *principals) addAcl(acl *freenas.Acl) {
+	if acl == nil {
+		return
+	}
+
+	for _, ace := range acl.Dacl {
+		kv := strings.SplitN(ace.Principal, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "user":
+			p.addUser(kv[1])
+		case "group":
+			p.addGroup(kv[1])
+		}
+	}
+}
+
+// Check ensures all referenced users and groups exist on the server,
+// missing ones are created if create is true
+func (p *principals) Check(server *freenas.FreenasServer, create bool) error {
+	groups, err := freenas.ListGroups(server)
+	if err != nil {
+		return err
+	}
+	existingGroups := map[string]int{}
+	for _, g := range groups {
+		existingGroups[g.Name] = g.Id
+	}
+
+	users, err := freenas.ListUsers(server)
+	if err != nil {
+		return err
+	}
+	existingUsers := map[string]bool{}
+	for _, u := range users {
+		existingUsers[u.Username] = true
+	}
+
+	var missingGroups, missingUsers []string
+	for name := range p.groups {
+		if _, ok := existingGroups[name]; !ok {
+			missingGroups = append(missingGroups, name)
+		}
+	}
+	for name := range p.users {
+		if !existingUsers[name] {
+			missingUsers = append(missingUsers, name)
+		}
+	}
+	sort.Strings(missingGroups)
+	sort.Strings(missingUsers)
+
+	if len(missingGroups) == 0 && len(missingUsers) == 0 {
+		return nil
+	}
+
+	if !create {
+		return fmt.Errorf("Missing principals on server \"%s\" - users: %v, groups: %v", server.Host, missingUsers, missingGroups)
+	}
+
+	for _, name := range missingGroups {
+		server.Log.Info("Creating missing group", "group", name)
+		group := freenas.Group{Name: name}
+		err = group.Create(server)
+		if err != nil {
+			return err
+		}
+		existingGroups[name] = group.Id
+	}
+
+	for _, name := range missingUsers {
+		server.Log.Info("Creating missing user", "user", name)
+		user := freenas.User{
+			Username:         name,
+			FullName:         principalFullName,
+			PasswordDisabled: true,
+		}
+		if id, ok := existingGroups[name]; ok {
+			user.Group = id
+		} else {
+			user.CreateGroup = true
+		}
+
+		err = user.Create(server)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
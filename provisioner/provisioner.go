@@ -7,59 +7,120 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/bytefmt"
-	"github.com/golang/glog"
 	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"github.com/nmaupu/freenas-provisioner/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 )
 
 var (
 	// freenasProvisioner is an implem of controller.Provisioner
 	_ controller.Provisioner = &freenasProvisioner{}
+
+	shareSecurityFlavors = []string{"sys", "krb5", "krb5i", "krb5p"}
 )
 
 type freenasProvisionerConfig struct {
 	// Dataset options
-	DatasetParentName               string
-	DatasetEnableQuotas             bool
-	DatasetEnableReservation        bool
-	DatasetEnableNamespaces         bool
-	DatasetNamespaceQuota           int64
-	DatasetNamespaceReservation     int64
-	DatasetEnableDeterministicNames bool
-	DatasetRetainPreExisting        bool
-	DatasetPermissionsMode          string
-	DatasetPermissionsUser          string
-	DatasetPermissionsGroup         string
+	DatasetParentName                string
+	DatasetEnableQuotas              bool
+	DatasetEnableReservation         bool
+	DatasetEnableNamespaces          bool
+	DatasetNamespaceQuota            int64
+	DatasetNamespaceReservation      int64
+	DatasetEnableDeterministicNames  bool
+	DatasetRetainPreExisting         bool
+	DatasetRetainNamespaces          bool
+	DatasetPermissionsMode           string
+	DatasetPermissionsUser           string
+	DatasetPermissionsGroup          string
+	DatasetPermissionsRecursive      bool
+	DatasetAclMode                   string
+	DatasetAclTemplate               []freenas.AccessControlEntry
+	DatasetOwnerFromAnnotations      bool
+	DatasetOwnerPermissionsMode      string
+	DatasetCreateMissingPrincipals   bool
+	DatasetEncryption                bool
+	DatasetEncryptionAlgorithm       string
+	DatasetEncryptionKeyFormat       string
+	DatasetEncryptionSecretNamespace string
+	MaxOverprovisionRatio            float64
+	UsageWarningPercent              float64
+
+	// Snapshot options
+	SnapshotSchedule  string
+	SnapshotRetention string
+
+	// Replication options
+	ReplicationTarget        string
+	ReplicationDeleteReplica bool
+
+	// Dry run: changes are logged instead of applied
+	DryRun bool
 
 	// Share options
-	ShareHost              string
-	ShareAlldirs           bool
-	ShareAllowedHosts      string
-	ShareAllowedNetworks   string
-	ShareMaprootUser       string
-	ShareMaprootGroup      string
-	ShareMapallUser        string
-	ShareMapallGroup       string
-	ShareRetainPreExisting bool
+	ShareHost                 string
+	ShareAlldirs              bool
+	ShareAllowedHosts         string
+	ShareAllowedNetworks      string
+	ShareMaprootUser          string
+	ShareMaprootGroup         string
+	ShareMapallUser           string
+	ShareMapallGroup          string
+	ShareRetainPreExisting    bool
+	ShareHostsFromConsumers   bool
+	ShareConsumersGracePeriod time.Duration
+	ShareSecurity             string
+	ShareMapallToOwner        bool
 
 	// Server options
 	ServerSecretNamespace string
 	ServerSecretName      string
+	ServerSecretNames     []string
 	ServerProtocol        string
 	ServerHost            string
 	ServerPort            int
 	ServerUsername        string
 	ServerPassword        string
+	ServerApiKey          string
 	ServerAllowInsecure   bool
+	ServerCACert          string
+	ServerClientCert      string
+	ServerClientKey       string
+	ServerName            string
+	ServerSPKIPin         string
+	ServerTopology        map[string]string
 }
 
+// GetConfig returns the configuration of a StorageClass using its first declared backend
 func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName string) (*freenasProvisionerConfig, error) {
-	class, err := p.Client.StorageV1().StorageClasses().Get(ctx, storageClassName, metav1.GetOptions{})
+	return p.GetBackendConfig(ctx, storageClassName, "")
+}
+
+// GetBackendConfig returns the configuration of a StorageClass using the backend
+// described by the given secret name (defaults to the first one declared by the class)
+func (p *freenasProvisioner) GetBackendConfig(ctx context.Context, storageClassName, secretName string) (*freenasProvisionerConfig, error) {
+	var class *storagev1.StorageClass
+	var err error
+	if p.classLister != nil {
+		class, err = p.classLister.Get(storageClassName)
+	} else {
+		class, err = p.Client.StorageV1().StorageClasses().Get(ctx, storageClassName, metav1.GetOptions{})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -73,9 +134,34 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 	var datasetNamespaceReservation int64 = 0
 	var datasetEnableDeterministicNames bool = true
 	var datasetRetainPreExisting bool = true
+	var datasetRetainNamespaces bool = true
 	var datasetPermissionsMode string = "0777"
 	var datasetPermissionsUser string = "root"
 	var datasetPermissionsGroup string = "wheel"
+	var datasetPermissionsRecursive bool = false
+	var datasetAclMode string = "unix"
+	var datasetAclTemplate []freenas.AccessControlEntry = defaultAclTemplate
+	var datasetAclTemplateConfigMap string = ""
+	var datasetOwnerFromAnnotations bool = false
+	var datasetOwnerPermissionsMode string = "0770"
+	var datasetCreateMissingPrincipals bool = false
+	var datasetEncryption bool = false
+	var datasetEncryptionAlgorithm string = defaultEncryptionAlgorithm
+	var datasetEncryptionKeyFormat string = "hex"
+	var datasetEncryptionSecretNamespace string = ""
+	var maxOverprovisionRatio float64 = 0
+	var usageWarningPercent float64 = 0
+
+	// snapshot defaults
+	var snapshotSchedule string = ""
+	var snapshotRetention string = defaultSnapshotRetention
+
+	// replication defaults
+	var replicationTarget string = ""
+	var replicationDeleteReplica bool = false
+
+	// dry run default
+	var dryRun bool = false
 
 	// share defaults
 	var shareHost string = ""
@@ -87,16 +173,14 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 	var shareMapallUser string = ""
 	var shareMapallGroup string = ""
 	var shareRetainPreExisting bool = true
+	var shareHostsFromConsumers bool = false
+	var shareConsumersGracePeriod time.Duration = 0
+	var shareSecurity string = ""
+	var shareMapallToOwner bool = false
 
 	// server options
 	var serverSecretNamespace string = "kube-system"
 	var serverSecretName string = "freenas-nfs"
-	var serverProtocol string = "http"
-	var serverHost string = "localhost"
-	var serverPort int = 80
-	var serverUsername string = "root"
-	var serverPassword string = ""
-	var serverAllowInsecure bool = false
 
 	// set values from StorageClass parameters
 	for k, v := range class.Parameters {
@@ -126,12 +210,58 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 			datasetEnableDeterministicNames, _ = strconv.ParseBool(v)
 		case "datasetRetainPreExisting":
 			datasetRetainPreExisting, _ = strconv.ParseBool(v)
+		case "datasetRetainNamespaces":
+			datasetRetainNamespaces, _ = strconv.ParseBool(v)
 		case "datasetPermissionsMode":
 			datasetPermissionsMode = v
 		case "datasetPermissionsUser":
 			datasetPermissionsUser = v
 		case "datasetPermissionsGroup":
 			datasetPermissionsGroup = v
+		case "datasetPermissionsRecursive":
+			datasetPermissionsRecursive, _ = strconv.ParseBool(v)
+		case "datasetAclMode":
+			if v != "unix" && v != "nfsv4" {
+				return nil, fmt.Errorf("Invalid datasetAclMode \"%s\", must be unix or nfsv4", v)
+			}
+			datasetAclMode = v
+		case "datasetAclTemplate":
+			datasetAclTemplate, err = ParseAclTemplate(v)
+			if err != nil {
+				return nil, err
+			}
+		case "datasetAclTemplateConfigMap":
+			datasetAclTemplateConfigMap = v
+		case "datasetOwnerFromAnnotations":
+			datasetOwnerFromAnnotations, _ = strconv.ParseBool(v)
+		case "datasetOwnerPermissionsMode":
+			datasetOwnerPermissionsMode = v
+		case "datasetCreateMissingPrincipals":
+			datasetCreateMissingPrincipals, _ = strconv.ParseBool(v)
+		case "datasetEncryption":
+			datasetEncryption, _ = strconv.ParseBool(v)
+		case "datasetEncryptionAlgorithm":
+			if !containsString(freenas.EncryptionAlgorithms, v) {
+				return nil, fmt.Errorf("Invalid datasetEncryptionAlgorithm \"%s\", must be one of %v", v, freenas.EncryptionAlgorithms)
+			}
+			datasetEncryptionAlgorithm = v
+		case "datasetEncryptionKeyFormat":
+			if v != "hex" && v != "passphrase" {
+				return nil, fmt.Errorf("Invalid datasetEncryptionKeyFormat \"%s\", must be hex or passphrase", v)
+			}
+			datasetEncryptionKeyFormat = v
+		case "datasetEncryptionSecretNamespace":
+			datasetEncryptionSecretNamespace = v
+		case "maxOverprovisionRatio":
+			maxOverprovisionRatio, err = strconv.ParseFloat(v, 64)
+			if err != nil || maxOverprovisionRatio < 0 {
+				return nil, fmt.Errorf("Invalid maxOverprovisionRatio \"%s\"", v)
+			}
+		case "usageWarningPercent":
+			usageWarningPercent, err = strconv.ParseFloat(v, 64)
+			if err != nil || usageWarningPercent < 0 {
+				return nil, fmt.Errorf("Invalid usageWarningPercent \"%s\"", v)
+			}
 
 		// Share options
 		case "shareHost":
@@ -152,6 +282,41 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 			shareMapallGroup = v
 		case "shareRetainPreExisting":
 			shareRetainPreExisting, _ = strconv.ParseBool(v)
+		case "shareHostsFromConsumers":
+			shareHostsFromConsumers, _ = strconv.ParseBool(v)
+		case "shareConsumersGracePeriod":
+			shareConsumersGracePeriod, err = time.ParseDuration(v)
+			if err != nil {
+				return nil, err
+			}
+		case "shareSecurity":
+			if !containsString(shareSecurityFlavors, v) {
+				return nil, fmt.Errorf("Invalid shareSecurity \"%s\", must be one of %v", v, shareSecurityFlavors)
+			}
+			shareSecurity = v
+		case "shareMapallToOwner":
+			shareMapallToOwner, _ = strconv.ParseBool(v)
+
+		// Snapshot options
+		case "snapshotSchedule":
+			if _, err = ParseSnapshotSchedule(v); err != nil {
+				return nil, err
+			}
+			snapshotSchedule = v
+		case "snapshotRetention":
+			if _, _, _, err = ParseSnapshotRetention(v); err != nil {
+				return nil, err
+			}
+			snapshotRetention = v
+
+		// Replication options
+		case "replicationTarget":
+			replicationTarget = v
+		case "replicationDeleteReplica":
+			replicationDeleteReplica, _ = strconv.ParseBool(v)
+
+		case "dryRun":
+			dryRun, _ = strconv.ParseBool(v)
 
 		// Server options
 		case "serverSecretNamespace":
@@ -161,7 +326,133 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		}
 	}
 
-	secret, err := p.GetSecret(ctx, serverSecretNamespace, serverSecretName)
+	if datasetAclMode == "nfsv4" && datasetAclTemplateConfigMap != "" {
+		datasetAclTemplate, err = p.GetAclTemplate(ctx, datasetAclTemplateConfigMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// serverSecretName may list several backends (comma-separated)
+	var serverSecretNames []string
+	for _, name := range strings.Split(serverSecretName, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			serverSecretNames = append(serverSecretNames, name)
+		}
+	}
+	if len(serverSecretNames) == 0 {
+		return nil, fmt.Errorf("No server secret declared for StorageClass \"%s\"", storageClassName)
+	}
+
+	if datasetEncryptionSecretNamespace == "" {
+		datasetEncryptionSecretNamespace = serverSecretNamespace
+	}
+
+	serverSecretName = serverSecretNames[0]
+	if secretName != "" {
+		serverSecretName = secretName
+	}
+
+	server, err := p.GetServerConfig(ctx, serverSecretNamespace, serverSecretName)
+	if err != nil {
+		return nil, err
+	}
+
+	if shareHost == "" {
+		shareHost = server.ServerHost
+	}
+
+	return &freenasProvisionerConfig{
+		// Dataset options
+		DatasetParentName:                datasetParentName,
+		DatasetEnableQuotas:              datasetEnableQuotas,
+		DatasetEnableReservation:         datasetEnableReservation,
+		DatasetEnableNamespaces:          datasetEnableNamespaces,
+		DatasetNamespaceQuota:            datasetNamespaceQuota,
+		DatasetNamespaceReservation:      datasetNamespaceReservation,
+		DatasetEnableDeterministicNames:  datasetEnableDeterministicNames,
+		DatasetRetainPreExisting:         datasetRetainPreExisting,
+		DatasetRetainNamespaces:          datasetRetainNamespaces,
+		DatasetPermissionsMode:           datasetPermissionsMode,
+		DatasetPermissionsUser:           datasetPermissionsUser,
+		DatasetPermissionsGroup:          datasetPermissionsGroup,
+		DatasetPermissionsRecursive:      datasetPermissionsRecursive,
+		DatasetAclMode:                   datasetAclMode,
+		DatasetAclTemplate:               datasetAclTemplate,
+		DatasetOwnerFromAnnotations:      datasetOwnerFromAnnotations,
+		DatasetOwnerPermissionsMode:      datasetOwnerPermissionsMode,
+		DatasetCreateMissingPrincipals:   datasetCreateMissingPrincipals,
+		DatasetEncryption:                datasetEncryption,
+		DatasetEncryptionAlgorithm:       datasetEncryptionAlgorithm,
+		DatasetEncryptionKeyFormat:       datasetEncryptionKeyFormat,
+		DatasetEncryptionSecretNamespace: datasetEncryptionSecretNamespace,
+		MaxOverprovisionRatio:            maxOverprovisionRatio,
+		UsageWarningPercent:              usageWarningPercent,
+
+		// Snapshot options
+		SnapshotSchedule:  snapshotSchedule,
+		SnapshotRetention: snapshotRetention,
+
+		// Replication options
+		ReplicationTarget:        replicationTarget,
+		ReplicationDeleteReplica: replicationDeleteReplica,
+
+		DryRun: dryRun,
+
+		// Share options
+		ShareHost:                 shareHost,
+		ShareAlldirs:              shareAlldirs,
+		ShareAllowedHosts:         shareAllowedHosts,
+		ShareAllowedNetworks:      shareAllowedNetworks,
+		ShareMaprootUser:          shareMaprootUser,
+		ShareMaprootGroup:         shareMaprootGroup,
+		ShareMapallUser:           shareMapallUser,
+		ShareMapallGroup:          shareMapallGroup,
+		ShareRetainPreExisting:    shareRetainPreExisting,
+		ShareHostsFromConsumers:   shareHostsFromConsumers,
+		ShareConsumersGracePeriod: shareConsumersGracePeriod,
+		ShareSecurity:             shareSecurity,
+		ShareMapallToOwner:        shareMapallToOwner,
+
+		// Server options
+		ServerSecretNamespace: serverSecretNamespace,
+		ServerSecretName:      serverSecretName,
+		ServerSecretNames:     serverSecretNames,
+		ServerProtocol:        server.ServerProtocol,
+		ServerHost:            server.ServerHost,
+		ServerPort:            server.ServerPort,
+		ServerUsername:        server.ServerUsername,
+		ServerPassword:        server.ServerPassword,
+		ServerApiKey:          server.ServerApiKey,
+		ServerAllowInsecure:   server.ServerAllowInsecure,
+		ServerCACert:          server.ServerCACert,
+		ServerClientCert:      server.ServerClientCert,
+		ServerClientKey:       server.ServerClientKey,
+		ServerName:            server.ServerName,
+		ServerSPKIPin:         server.ServerSPKIPin,
+		ServerTopology:        server.ServerTopology,
+	}, nil
+}
+
+// GetServerConfig returns a configuration with only the server options set
+// from the connection details of the given secret
+func (p *freenasProvisioner) GetServerConfig(ctx context.Context, secretNamespace, secretName string) (*freenasProvisionerConfig, error) {
+	// server defaults
+	var serverProtocol string = "http"
+	var serverHost string = "localhost"
+	var serverPort int = 80
+	var serverUsername string = "root"
+	var serverPassword string = ""
+	var serverApiKey string = ""
+	var serverAllowInsecure bool = false
+	var serverCACert string = ""
+	var serverClientCert string = ""
+	var serverClientKey string = ""
+	var serverName string = ""
+	var serverSPKIPin string = ""
+	var serverTopology map[string]string = map[string]string{}
+
+	secret, err := p.GetSecret(ctx, secretNamespace, secretName)
 	if err != nil {
 		return nil, err
 	}
@@ -179,80 +470,139 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 			serverUsername = BytesToString(v)
 		case "password":
 			serverPassword = BytesToString(v)
+		case "apiKey":
+			serverApiKey = BytesToString(v)
 		case "allowInsecure":
 			serverAllowInsecure, _ = strconv.ParseBool(BytesToString(v))
+		case "caCert":
+			serverCACert = BytesToString(v)
+		case "clientCert":
+			serverClientCert = BytesToString(v)
+		case "clientKey":
+			serverClientKey = BytesToString(v)
+		case "serverName":
+			serverName = BytesToString(v)
+		case "spkiPin":
+			serverSPKIPin = BytesToString(v)
+		case "topology":
+			serverTopology, err = ParseTopology(BytesToString(v))
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if shareHost == "" {
-		shareHost = serverHost
-	}
-
 	return &freenasProvisionerConfig{
-		// Dataset options
-		DatasetParentName:               datasetParentName,
-		DatasetEnableQuotas:             datasetEnableQuotas,
-		DatasetEnableReservation:        datasetEnableReservation,
-		DatasetEnableNamespaces:         datasetEnableNamespaces,
-		DatasetNamespaceQuota:           datasetNamespaceQuota,
-		DatasetNamespaceReservation:     datasetNamespaceReservation,
-		DatasetEnableDeterministicNames: datasetEnableDeterministicNames,
-		DatasetRetainPreExisting:        datasetRetainPreExisting,
-		DatasetPermissionsMode:          datasetPermissionsMode,
-		DatasetPermissionsUser:          datasetPermissionsUser,
-		DatasetPermissionsGroup:         datasetPermissionsGroup,
-
-		// Share options
-		ShareHost:              shareHost,
-		ShareAlldirs:           shareAlldirs,
-		ShareAllowedHosts:      shareAllowedHosts,
-		ShareAllowedNetworks:   shareAllowedNetworks,
-		ShareMaprootUser:       shareMaprootUser,
-		ShareMaprootGroup:      shareMaprootGroup,
-		ShareMapallUser:        shareMapallUser,
-		ShareMapallGroup:       shareMapallGroup,
-		ShareRetainPreExisting: shareRetainPreExisting,
-
-		// Server options
-		ServerSecretNamespace: serverSecretNamespace,
-		ServerSecretName:      serverSecretName,
+		ServerSecretNamespace: secretNamespace,
+		ServerSecretName:      secretName,
 		ServerProtocol:        serverProtocol,
 		ServerHost:            serverHost,
 		ServerPort:            serverPort,
 		ServerUsername:        serverUsername,
 		ServerPassword:        serverPassword,
+		ServerApiKey:          serverApiKey,
 		ServerAllowInsecure:   serverAllowInsecure,
+		ServerCACert:          serverCACert,
+		ServerClientCert:      serverClientCert,
+		ServerClientKey:       serverClientKey,
+		ServerName:            serverName,
+		ServerSPKIPin:         serverSPKIPin,
+		ServerTopology:        serverTopology,
 	}, nil
 }
 
 type freenasProvisioner struct {
 	Client     kubernetes.Interface
 	Identifier string
+	Recorder   record.EventRecorder
+	DryRun     bool
+	// whether snapshots whose retention is a count are pruned
+	SnapshotPruning bool
+
+	// listers used instead of the API when set, by controllers reading the
+	// configuration of every PV on each resync
+	classLister  storagelisters.StorageClassLister
+	secretLister corelisters.SecretLister
 }
 
-func New(client kubernetes.Interface, identifier string) controller.Provisioner {
+// NewEventRecorder returns the recorder of the events of the provisioner and the controllers,
+// to share between them, the returned func stops recording
+func NewEventRecorder(client kubernetes.Interface, identifier string) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: identifier}), broadcaster.Shutdown
+}
+
+// New returns the provisioner, with dryRun changes on FreeNAS are logged instead of applied
+// snapshotPruning tells whether the snapshot pruner runs, retentions given as a count
+// of snapshots are refused otherwise since nothing would delete them
+func New(client kubernetes.Interface, identifier string, recorder record.EventRecorder, dryRun, snapshotPruning bool) controller.Provisioner {
+	p := newFreenasProvisioner(client, identifier, recorder)
+	p.DryRun = dryRun
+	p.SnapshotPruning = snapshotPruning
+	return p
+}
+
+func newFreenasProvisioner(client kubernetes.Interface, identifier string, recorder record.EventRecorder) *freenasProvisioner {
 	return &freenasProvisioner{
 		Client:     client,
 		Identifier: identifier,
+		Recorder:   recorder,
 	}
 }
 
 // Provision a dataset and creates an NFS share on Freenas side
 func (p *freenasProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	ctx, span := tracing.Start(ctx, "Provision", trace.WithAttributes(
+		attribute.String("k8s.pvc.name", options.PVC.Name),
+		attribute.String("k8s.namespace.name", options.PVC.Namespace),
+		attribute.String("k8s.pv.name", options.PVName),
+		attribute.String("k8s.storageclass.name", *options.PVC.Spec.StorageClassName),
+	))
+	pv, state, err := p.provision(ctx, options)
+	tracing.End(span, err)
+	return pv, state, err
+}
+
+func (p *freenasProvisioner) provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	var err error
 
+	requestId := logging.NewRequestId()
+	log := logging.Log.WithValues(
+		"requestId", requestId,
+		"pvc", options.PVC.Name,
+		"namespace", options.PVC.Namespace,
+		"pv", options.PVName,
+		"storageclass", *options.PVC.Spec.StorageClassName,
+	)
+	if traceId := tracing.TraceId(ctx); traceId != "" {
+		log = log.WithValues("traceId", traceId)
+	}
+	span := trace.SpanFromContext(ctx)
+
 	// get config
 	config, err := p.GetConfig(ctx, *options.PVC.Spec.StorageClassName)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
-	//glog.Infof("%+v\n", config)
+
+	// select a backend reachable from the selected node / allowed topologies
+	config, err = p.SelectBackend(ctx, log, options, config)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	log = log.WithValues("backend", config.ServerSecretName)
+	span.SetAttributes(attribute.String("freenas.backend", config.ServerSecretName), attribute.String("freenas.host", config.ServerHost))
+
+	dryRun := p.DryRun || config.DryRun
 
 	// get server
 	freenasServer, err := p.GetServer(*config)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
+	freenasServer = freenasServer.WithLogger(log, requestId).WithContext(ctx)
 
 	// get parent dataset
 	parentDs := freenas.Dataset{
@@ -294,6 +644,30 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 		datasetRefreservation = volSize.Value()
 	}
 
+	permissionsMode, permissionsUser, permissionsGroup := config.DatasetPermissionsMode, config.DatasetPermissionsUser, config.DatasetPermissionsGroup
+	maprootUser, maprootGroup := config.ShareMaprootUser, config.ShareMaprootGroup
+	mapallUser, mapallGroup := config.ShareMapallUser, config.ShareMapallGroup
+	if config.DatasetOwnerFromAnnotations {
+		uid, gid, err := p.GetOwner(ctx, options.PVC)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+
+		if uid != "" {
+			permissionsMode, permissionsUser, permissionsGroup = config.DatasetOwnerPermissionsMode, uid, gid
+			if config.ShareMapallToOwner {
+				user, group, err := ownerNames(freenasServer, uid, gid)
+				if err != nil {
+					return nil, controller.ProvisioningFinished, err
+				}
+				maprootUser, maprootGroup = "", ""
+				mapallUser, mapallGroup = user, group
+			}
+		} else {
+			log.Info("No owner annotation found for claim, using default owner", "user", permissionsUser, "group", permissionsGroup)
+		}
+	}
+
 	ds := freenas.Dataset{
 		Pool:           parentDs.Pool,
 		Name:           dsPath,
@@ -309,14 +683,111 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 		Alldirs:      config.ShareAlldirs,
 		Hosts:        config.ShareAllowedHosts,
 		Network:      config.ShareAllowedNetworks,
-		MaprootUser:  config.ShareMaprootUser,
-		MaprootGroup: config.ShareMaprootGroup,
-		MapallUser:   config.ShareMapallUser,
-		MapallGroup:  config.ShareMapallGroup,
+		MaprootUser:  maprootUser,
+		MaprootGroup: maprootGroup,
+		MapallUser:   mapallUser,
+		MapallGroup:  mapallGroup,
 		Comment:      TruncateString(fmt.Sprintf("freenas-provisioner (%s): %s", p.Identifier, dsPath), 120),
 	}
 
-	glog.Infof("Creating dataset: \"%s\", NFS share: \"%s\"", ds.Name, path)
+	var acl *freenas.Acl
+	if config.DatasetAclMode == "nfsv4" {
+		vars := map[string]string{
+			"pvc.name":      meta.GetName(),
+			"pvc.namespace": meta.GetNamespace(),
+			"pv.name":       options.PVName,
+			"storageclass":  *options.PVC.Spec.StorageClassName,
+		}
+		for k, v := range meta.GetAnnotations() {
+			vars["pvc.annotations."+k] = v
+		}
+
+		dacl, err := ExpandAclTemplate(config.DatasetAclTemplate, vars)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		acl = &freenas.Acl{
+			Path: path,
+			Dacl: dacl,
+		}
+	}
+
+	task, snapshotRetentionCount, err := snapshotTask(config, meta.GetAnnotations(), dsPath)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	var target *replicationTarget
+	if name := replicationTargetName(config, meta.GetAnnotations()); name != "" {
+		target, err = p.GetReplicationTarget(ctx, config.ServerSecretNamespace, name)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+
+		// replication needs a periodic snapshot task to follow
+		if task == nil {
+			replicationConfig := *config
+			replicationConfig.SnapshotSchedule = defaultReplicationSchedule
+			task, snapshotRetentionCount, err = snapshotTask(&replicationConfig, nil, dsPath)
+			if err != nil {
+				return nil, controller.ProvisioningFinished, err
+			}
+		}
+	}
+
+	// nothing else deletes the snapshots of a retention given as a count
+	if snapshotRetentionCount > 0 && !p.SnapshotPruning {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("Snapshot retention of %d snapshots requires the snapshot pruner (--snapshot-prune-interval)", snapshotRetentionCount)
+	}
+
+	if config.ShareSecurity != "" {
+		share.Security = []string{config.ShareSecurity}
+	}
+
+	mountOptions, err := ShareMountOptions(config.ShareSecurity, options.StorageClass.MountOptions)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	if config.ShareHostsFromConsumers {
+		// share is opened to consuming nodes by the share consumers controller
+		share.Hosts = NoConsumerHost
+		share.Network = ""
+		if options.SelectedNode != nil {
+			if hosts := NodeAddresses(options.SelectedNode); len(hosts) > 0 {
+				share.Hosts = strings.Join(hosts, " ")
+			}
+		}
+	}
+
+	// ensure referenced users and groups exist before creating anything
+	refs := newPrincipals()
+	refs.addUser(permissionsUser)
+	refs.addGroup(permissionsGroup)
+	refs.addUser(share.MaprootUser)
+	refs.addGroup(share.MaprootGroup)
+	refs.addUser(share.MapallUser)
+	refs.addGroup(share.MapallGroup)
+	refs.addAcl(acl)
+	err = refs.Check(freenasServer, config.DatasetCreateMissingPrincipals && !dryRun)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	// ensure the dataset fits before creating anything
+	if !config.DatasetEnableDeterministicNames || (&freenas.Dataset{Name: ds.Name}).Get(freenasServer) != nil {
+		volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+		err = p.CheckCapacity(ctx, freenasServer, config, &parentDs, filepath.Join(parentDs.Name, dsNamespace), volSize.Value())
+		if err != nil {
+			p.Recorder.Event(options.PVC, v1.EventTypeWarning, "ProvisioningInsufficientCapacity", err.Error())
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	log = log.WithValues("dataset", ds.Name)
+	span.SetAttributes(attribute.String("freenas.dataset", ds.Name))
+	freenasServer = freenasServer.WithLogger(log, requestId)
+	log.Info("Creating dataset and NFS share", "path", path)
 
 	// Provisioning dataset and nfs share
 	var datasetPreExisted, sharePreExisted = false, false
@@ -326,65 +797,150 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 			Name:        filepath.Join(parentDs.Name, dsNamespace),
 			Quota:       config.DatasetNamespaceQuota,
 			Reservation: config.DatasetNamespaceReservation,
-			Comments:    "k8s provisioned namespace",
+			Comments:    namespaceDatasetComments,
 		}
 
 		err = nsDs.Get(freenasServer)
 		if err != nil {
-			glog.Infof("creating namespace dataset \"%s\"", nsDs.Name)
-			err = nsDs.Create(freenasServer)
+			log.Info("Creating namespace dataset", "namespaceDataset", nsDs.Name)
+			err = p.apply(log, dryRun, options.PVC, nsDs.CreateRequest(), func() error { return nsDs.Create(freenasServer) })
 		} else {
-			glog.Infof("namespace dataset \"%s\" already exists", nsDs.Name)
+			log.Info("Namespace dataset already exists", "namespaceDataset", nsDs.Name)
 		}
 	}
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
+	encryptionKeySecret, keyCreated := "", false
+	if config.DatasetEncryption && dryRun {
+		ds.Encryption = &freenas.DatasetEncryption{Algorithm: config.DatasetEncryptionAlgorithm}
+	} else if config.DatasetEncryption {
+		ds.Encryption, keyCreated, err = p.GetEncryptionKey(ctx, config, options.PVName)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		encryptionKeySecret = encryptionKeySecretName(options.PVName)
+	}
+
 	if config.DatasetEnableDeterministicNames {
 		err = ds.Get(freenasServer)
 
 		if err != nil {
-			err = ds.Create(freenasServer)
+			err = p.apply(log, dryRun, options.PVC, ds.CreateRequest(), func() error { return ds.Create(freenasServer) })
 		} else {
 			datasetPreExisted = true
-			glog.Infof("dataset \"%s\" already exists", ds.Name)
+			log.Info("Dataset already exists")
 		}
 	} else {
-		err = ds.Create(freenasServer)
+		err = p.apply(log, dryRun, options.PVC, ds.CreateRequest(), func() error { return ds.Create(freenasServer) })
 	}
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
+	// a pre-existing dataset is not encrypted with a key of ours
+	if datasetPreExisted && keyCreated {
+		err = p.DeleteEncryptionKey(ctx, log, config.DatasetEncryptionSecretNamespace, encryptionKeySecret)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		encryptionKeySecret = ""
+	}
+
 	if config.DatasetEnableDeterministicNames {
 		err = share.Get(freenasServer)
 		if err != nil {
-			err = share.Create(freenasServer)
+			err = p.apply(log, dryRun, options.PVC, share.CreateRequest(), func() error { return share.Create(freenasServer) })
 		} else {
 			sharePreExisted = true
-			glog.Infof("share \"%s\" already exists", path)
+			log.Info("NFS share already exists", "path", path)
 		}
 	} else {
-		err = share.Create(freenasServer)
+		err = p.apply(log, dryRun, options.PVC, share.CreateRequest(), func() error { return share.Create(freenasServer) })
 	}
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
+	log = log.WithValues("shareId", share.Id)
+	freenasServer = freenasServer.WithLogger(log, requestId)
 
-	glog.Infof("setting permissions on path \"%s\" to - mode: %s, owner: %s:%s", path, config.DatasetPermissionsMode, config.DatasetPermissionsUser, config.DatasetPermissionsGroup)
+	log.Info("Setting permissions", "path", path, "mode", permissionsMode, "user", permissionsUser, "group", permissionsGroup)
 	permission := freenas.Permission{
 		Path:  path,
 		Acl:   "unix",
-		Mode:  config.DatasetPermissionsMode,
-		User:  config.DatasetPermissionsUser,
-		Group: config.DatasetPermissionsGroup,
+		Mode:  permissionsMode,
+		User:  permissionsUser,
+		Group: permissionsGroup,
+	}
+	if acl != nil {
+		permission.Acl = "windows"
+	}
+	if datasetPreExisted && config.DatasetPermissionsRecursive {
+		var request freenas.Request
+		request, err = permission.PutRecursiveRequest(freenasServer)
+		if err == nil {
+			err = p.apply(log, dryRun, options.PVC, request, func() error { return permission.PutRecursive(freenasServer) })
+		}
+	} else {
+		err = p.apply(log, dryRun, options.PVC, permission.PutRequest(), func() error { return permission.Put(freenasServer) })
 	}
-	err = permission.Put(freenasServer)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
+	if acl != nil {
+		log.Info("Setting NFSv4 ACL", "path", path, "entries", len(acl.Dacl))
+		err = p.apply(log, dryRun, options.PVC, acl.PutRequest(), func() error { return acl.Put(freenasServer) })
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	snapshotTaskId := 0
+	if task != nil {
+		// a previous attempt failing afterwards (ie: on the replication task) may have created it
+		var existing *freenas.SnapshotTask
+		existing, err = freenas.FindSnapshotTask(freenasServer, task.Dataset, task.NamingSchema)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		if existing != nil {
+			log.Info("Reusing periodic snapshot task", "snapshotTaskId", existing.Id)
+			task = existing
+		} else {
+			log.Info("Creating periodic snapshot task", "schedule", fmt.Sprintf("%+v", task.Schedule))
+			err = p.apply(log, dryRun, options.PVC, task.CreateRequest(), func() error { return task.Create(freenasServer) })
+			if err != nil {
+				return nil, controller.ProvisioningFinished, err
+			}
+		}
+		snapshotTaskId = task.Id
+	}
+
+	replicationTaskId, replicaSecret, replicaDataset, replicaState := 0, "", "", ""
+	if target != nil {
+		replication := replicationTask(
+			fmt.Sprintf("freenas-provisioner (%s): %s", p.Identifier, dsPath),
+			ds.Name, filepath.Join(target.TargetDataset, dsNamespace, dsName),
+			target.SshCredentials, snapshotTaskId,
+		)
+		log.Info("Creating replication task", "replica", replication.TargetDataset, "replicationTarget", target.SecretName)
+		err = p.apply(log, dryRun, options.PVC, replication.CreateRequest(), func() error { return replication.Create(freenasServer) })
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		replicationTaskId = replication.Id
+		replicaSecret = target.SecretName
+		replicaDataset = replication.TargetDataset
+		replicaState = replicationState(replication)
+	}
+
+	if dryRun {
+		return nil, controller.ProvisioningFinished, ErrDryRun
+	}
+	log.Info("Volume provisioned")
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: options.PVName,
@@ -398,12 +954,24 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 				"datasetParent":                 config.DatasetParentName,
 				"dataset":                       ds.Name,
 				"pool":                          parentDs.Pool,
+				"serverSecretNamespace":         config.ServerSecretNamespace,
+				"serverSecretName":              config.ServerSecretName,
+				"shareHostsFromConsumers":       strconv.FormatBool(config.ShareHostsFromConsumers),
+				"snapshotTaskId":                strconv.Itoa(snapshotTaskId),
+				"snapshotRetentionCount":        strconv.Itoa(snapshotRetentionCount),
+				"replicationTaskId":             strconv.Itoa(replicationTaskId),
+				"replicationTarget":             replicaSecret,
+				"replicationTargetDataset":      replicaDataset,
+				"replicationState":              replicaState,
+				"encryptionKeySecretNamespace":  config.DatasetEncryptionSecretNamespace,
+				"encryptionKeySecret":           encryptionKeySecret,
 			},
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
+			NodeAffinity:                  TopologyNodeAffinity(config.ServerTopology),
 			AccessModes:                   options.PVC.Spec.AccessModes,
-			MountOptions:                  options.StorageClass.MountOptions,
+			MountOptions:                  mountOptions,
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
@@ -438,6 +1006,22 @@ func (p *iscsiProvisioner) SupportsBlock() bool {
 */
 
 func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	attributes := []attribute.KeyValue{
+		attribute.String("k8s.pv.name", volume.Name),
+		attribute.String("k8s.storageclass.name", volume.Spec.StorageClassName),
+		attribute.String("freenas.backend", volume.Annotations["serverSecretName"]),
+		attribute.String("freenas.dataset", volume.Annotations["dataset"]),
+	}
+	if claim := volume.Spec.ClaimRef; claim != nil {
+		attributes = append(attributes, attribute.String("k8s.pvc.name", claim.Name), attribute.String("k8s.namespace.name", claim.Namespace))
+	}
+	ctx, span := tracing.Start(ctx, "Delete", trace.WithAttributes(attributes...))
+	err := p.delete(ctx, volume)
+	tracing.End(span, err)
+	return err
+}
+
+func (p *freenasProvisioner) delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	var datasetPreExisted, sharePreExisted bool = false, false
 	var shareId int
 
@@ -461,18 +1045,34 @@ func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVo
 
 	var err error
 
-	// get config
-	config, err := p.GetConfig(ctx, volume.Spec.StorageClassName)
+	requestId := logging.NewRequestId()
+	log := logging.Log.WithValues(
+		"requestId", requestId,
+		"pv", volume.Name,
+		"storageclass", volume.Spec.StorageClassName,
+		"backend", volume.Annotations["serverSecretName"],
+	)
+	if claim := volume.Spec.ClaimRef; claim != nil {
+		log = log.WithValues("pvc", claim.Name, "namespace", claim.Namespace)
+	}
+	if traceId := tracing.TraceId(ctx); traceId != "" {
+		log = log.WithValues("traceId", traceId)
+	}
+
+	// get config of the backend the volume has been provisioned on
+	config, err := p.GetBackendConfig(ctx, volume.Spec.StorageClassName, volume.Annotations["serverSecretName"])
 	if err != nil {
 		return err
 	}
-	//glog.Infof("%+v\n", config)
+
+	dryRun := p.DryRun || config.DryRun
 
 	// get server
 	freenasServer, err := p.GetServer(*config)
 	if err != nil {
 		return err
 	}
+	freenasServer = freenasServer.WithLogger(log, requestId).WithContext(ctx)
 
 	// get parent dataset
 	parentDs := freenas.Dataset{
@@ -503,15 +1103,47 @@ func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVo
 			Name: config.DatasetParentName + strings.SplitN(path, config.DatasetParentName, 2)[1],
 		}
 	}
-	glog.Infof("Deleting dataset: \"%s\", NFS share: \"%s\"", ds.Name, path)
+	log = log.WithValues("dataset", ds.Name, "shareId", shareId)
+	freenasServer = freenasServer.WithLogger(log, requestId)
+	log.Info("Deleting dataset and NFS share", "path", path)
+
+	// delete replication task before the snapshot task it follows
+	replicationTaskId, _ := strconv.Atoi(volume.Annotations["replicationTaskId"])
+	if replicationTaskId > 0 {
+		replication := freenas.ReplicationTask{Id: replicationTaskId}
+		err = replication.Get(freenasServer)
+		if err != nil {
+			log.Info("Could not find replication task on server side, already deleted?", "replicationTaskId", replicationTaskId)
+		} else {
+			err = p.apply(log, dryRun, volume, replication.DeleteRequest(), func() error { return replication.Delete(freenasServer) })
+			if err != nil {
+				return errors.New(fmt.Sprintf("Could not delete replication task \"%d\". Error: %v", replicationTaskId, err))
+			}
+		}
+	}
+
+	// delete periodic snapshot task
+	snapshotTaskId, _ := strconv.Atoi(volume.Annotations["snapshotTaskId"])
+	if snapshotTaskId > 0 {
+		task := freenas.SnapshotTask{Id: snapshotTaskId}
+		err = task.Get(freenasServer)
+		if err != nil {
+			log.Info("Could not find snapshot task on server side, already deleted?", "snapshotTaskId", snapshotTaskId)
+		} else {
+			err = p.apply(log, dryRun, volume, task.DeleteRequest(), func() error { return task.Delete(freenasServer) })
+			if err != nil {
+				return errors.New(fmt.Sprintf("Could not delete snapshot task \"%d\". Error: %v", snapshotTaskId, err))
+			}
+		}
+	}
 
 	// delete share
 	if (sharePreExisted == true && !config.ShareRetainPreExisting) || !sharePreExisted {
 		err = share.Get(freenasServer)
 		if err != nil {
-			glog.Warningf(fmt.Sprintf("Could not find NFS share \"%s\" on server side, already deleted?", path))
+			log.Info("Could not find NFS share on server side, already deleted?", "path", path)
 		} else {
-			err = share.Delete(freenasServer)
+			err = p.apply(log, dryRun, volume, share.DeleteRequest(), func() error { return share.Delete(freenasServer) })
 			if err != nil {
 				return errors.New(fmt.Sprintf("Could not delete NFS share \"%s\" on server side, ignoring. Error: %v", path, err))
 			}
@@ -522,30 +1154,73 @@ func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVo
 	if (datasetPreExisted == true && !config.DatasetRetainPreExisting) || !datasetPreExisted {
 		err = ds.Get(freenasServer)
 		if err != nil {
-			glog.Warningf(fmt.Sprintf("Could not find dataset \"%s\" on server side, already deleted ?", ds.Name))
+			log.Info("Could not find dataset on server side, already deleted?")
 		} else {
-			err = ds.Delete(freenasServer)
+			err = p.apply(log, dryRun, volume, ds.DeleteRequest(), func() error { return ds.Delete(freenasServer) })
 			if err != nil {
 				return errors.New(fmt.Sprintf("Cannot delete dataset \"%s\". Error: %v", ds.Name, err))
 			}
 		}
 	}
 
+	// delete replica
+	replicaName := volume.Annotations["replicationTargetDataset"]
+	if config.ReplicationDeleteReplica && replicaName != "" && !dryRun {
+		err = p.DeleteReplica(ctx, log, config.ServerSecretNamespace, volume.Annotations["replicationTarget"], replicaName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// delete encryption key once the dataset is gone
+	if encryptionKeySecret := volume.Annotations["encryptionKeySecret"]; encryptionKeySecret != "" && !datasetPreExisted && !dryRun {
+		err = p.DeleteEncryptionKey(ctx, log, volume.Annotations["encryptionKeySecretNamespace"], encryptionKeySecret)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Cannot delete encryption key secret \"%s\". Error: %v", encryptionKeySecret, err))
+		}
+	}
+
+	// delete namespace dataset once empty
+	if config.DatasetEnableNamespaces && !config.DatasetRetainNamespaces && !dryRun {
+		nsDsName := filepath.Dir(ds.Name)
+		if nsDsName != config.DatasetParentName && filepath.Dir(nsDsName) == config.DatasetParentName {
+			err = p.CleanupNamespaceDataset(freenasServer, nsDsName, false, volume)
+			if err != nil {
+				log.Error(err, "Cannot cleanup namespace dataset", "namespaceDataset", nsDsName)
+			}
+		}
+	}
+
+	if dryRun {
+		return ErrDryRun
+	}
+	log.Info("Volume deleted")
+
 	return nil
 }
 
 func (p *freenasProvisioner) GetServer(config freenasProvisionerConfig) (*freenas.FreenasServer, error) {
 	return freenas.NewFreenasServer(
 		config.ServerProtocol, config.ServerHost, config.ServerPort,
-		config.ServerUsername, config.ServerPassword,
-		config.ServerAllowInsecure,
-	), nil
+		config.ServerUsername, config.ServerPassword, config.ServerApiKey,
+		freenas.TLSOptions{
+			InsecureSkipVerify: config.ServerAllowInsecure,
+			CACert:             []byte(config.ServerCACert),
+			ClientCert:         []byte(config.ServerClientCert),
+			ClientKey:          []byte(config.ServerClientKey),
+			ServerName:         config.ServerName,
+			SPKIPin:            config.ServerSPKIPin,
+		},
+	)
 }
 
 func (p *freenasProvisioner) GetSecret(ctx context.Context, namespace, secretName string) (*v1.Secret, error) {
 	if p.Client == nil {
 		return nil, fmt.Errorf("Cannot get kube client")
 	}
+	if p.secretLister != nil {
+		return p.secretLister.Secrets(namespace).Get(secretName)
+	}
 	return p.Client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
 }
 
@@ -0,0 +1,229 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	namespaceQuotaResyncPeriod = 5 * time.Minute
+)
+
+// NamespaceQuotaController keeps the quota of namespace datasets in sync with
+// the storage requests limit of the namespace ResourceQuotas
+type NamespaceQuotaController struct {
+	provisioner     *freenasProvisioner
+	provisionerName string
+	queue           workqueue.RateLimitingInterface
+
+	informerFactory informers.SharedInformerFactory
+	quotaLister     corelisters.ResourceQuotaLister
+	classLister     storagelisters.StorageClassLister
+}
+
+// namespaceQuota is the quota to set on a namespace dataset
+type namespaceQuota struct {
+	config *freenasProvisionerConfig
+	quota  int64
+	source *v1.ResourceQuota
+	// set if any class sharing the dataset is in dry run mode
+	dryRun bool
+}
+
+func NewNamespaceQuotaController(client kubernetes.Interface, identifier string, recorder record.EventRecorder, provisionerName string) *NamespaceQuotaController {
+	factory := informers.NewSharedInformerFactory(client, namespaceQuotaResyncPeriod)
+	c := &NamespaceQuotaController{
+		provisioner:     newFreenasProvisioner(client, identifier, recorder),
+		provisionerName: provisionerName,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "namespace-quota"),
+		informerFactory: factory,
+		quotaLister:     factory.Core().V1().ResourceQuotas().Lister(),
+		classLister:     factory.Storage().V1().StorageClasses().Lister(),
+	}
+
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if rq, ok := obj.(*v1.ResourceQuota); ok {
+			c.queue.Add(rq.Namespace)
+		}
+	}
+	factory.Core().V1().ResourceQuotas().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	factory.Storage().V1().StorageClasses().Informer()
+
+	return c
+}
+
+// Run watches ResourceQuotas until the context is done
+func (c *NamespaceQuotaController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+
+	logging.Log.Info("Starting namespace quota controller")
+	c.informerFactory.Start(ctx.Done())
+	c.informerFactory.WaitForCacheSync(ctx.Done())
+
+	go func() {
+		for c.processNextItem(ctx) {
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+func (c *NamespaceQuotaController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.reconcile(ctx, key.(string))
+	if err != nil {
+		logging.Log.Error(err, "Cannot sync dataset quota of namespace", "namespace", key)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *NamespaceQuotaController) reconcile(ctx context.Context, namespace string) error {
+	quotas, err := c.quotaLister.ResourceQuotas(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	classes, err := c.classLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	// several classes may share the same namespace dataset, the lowest quota wins
+	desired := map[string]*namespaceQuota{}
+	for _, class := range classes {
+		if class.Provisioner != c.provisionerName {
+			continue
+		}
+
+		config, err := c.provisioner.GetConfig(ctx, class.Name)
+		if err != nil {
+			return err
+		}
+		if !config.DatasetEnableNamespaces {
+			continue
+		}
+
+		quota, source := storageRequestsLimit(quotas, class.Name)
+		if source == nil {
+			quota = config.DatasetNamespaceQuota
+		}
+
+		for _, secretName := range config.ServerSecretNames {
+			backendConfig, err := c.provisioner.GetBackendConfig(ctx, class.Name, secretName)
+			if err != nil {
+				return err
+			}
+
+			key := fmt.Sprintf("%s:%d/%s", backendConfig.ServerHost, backendConfig.ServerPort, filepath.Join(backendConfig.DatasetParentName, namespace))
+			current, ok := desired[key]
+			if !ok || (quota > 0 && (current.quota == 0 || quota < current.quota)) {
+				desired[key] = &namespaceQuota{config: backendConfig, quota: quota, source: source, dryRun: backendConfig.DryRun || (ok && current.dryRun)}
+			} else if backendConfig.DryRun {
+				current.dryRun = true
+			}
+		}
+	}
+
+	for _, nq := range desired {
+		err = c.apply(namespace, nq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *NamespaceQuotaController) apply(namespace string, nq *namespaceQuota) error {
+	freenasServer, err := c.provisioner.GetServer(*nq.config)
+	if err != nil {
+		return err
+	}
+
+	nsDs := freenas.Dataset{
+		Name: filepath.Join(nq.config.DatasetParentName, namespace),
+	}
+	if nsDs.Get(freenasServer) != nil {
+		// not provisioned yet
+		return nil
+	}
+
+	if nq.quota > 0 && nsDs.Used > nq.quota {
+		msg := fmt.Sprintf("Usage %s of dataset \"%s\" on server \"%s\" is already over the storage quota %s",
+			bytefmt.ByteSize(uint64(nsDs.Used)), nsDs.Name, nq.config.ServerHost, bytefmt.ByteSize(uint64(nq.quota)))
+		freenasServer.Log.Info(msg, "namespace", namespace)
+		if nq.source != nil {
+			c.provisioner.Recorder.Event(nq.source, v1.EventTypeWarning, "NamespaceDatasetOverQuota", msg)
+		}
+	}
+
+	if nsDs.Quota == nq.quota {
+		return nil
+	}
+
+	freenasServer.Log.Info("Setting quota of namespace dataset", "dataset", nsDs.Name, "quota", quotaString(nq.quota), "previous", quotaString(nsDs.Quota))
+	nsDs.Quota = nq.quota
+	return c.provisioner.apply(freenasServer.Log, nq.dryRun, nq.source, nsDs.UpdateRequest(), func() error { return nsDs.Update(freenasServer) })
+}
+
+// storageRequestsLimit returns the lowest storage requests limit applying to a class
+// (<class>.storageclass.storage.k8s.io/requests.storage, then requests.storage)
+// and the ResourceQuota defining it (nil if none)
+func storageRequestsLimit(quotas []*v1.ResourceQuota, className string) (int64, *v1.ResourceQuota) {
+	classResource := v1.ResourceName(className + ".storageclass.storage.k8s.io/requests.storage")
+
+	var limit int64 = 0
+	var source *v1.ResourceQuota
+	for _, resourceName := range []v1.ResourceName{classResource, v1.ResourceRequestsStorage} {
+		for _, rq := range quotas {
+			hard, ok := rq.Spec.Hard[resourceName]
+			if ok && (source == nil || hard.Value() < limit) {
+				limit = hard.Value()
+				source = rq
+			}
+		}
+		if source != nil {
+			return limit, source
+		}
+	}
+
+	return 0, nil
+}
+
+func quotaString(quota int64) string {
+	if quota <= 0 {
+		return "none"
+	}
+	return bytefmt.ByteSize(uint64(quota))
+}
@@ -0,0 +1,117 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+)
+
+const (
+	ReplicationTargetAnnotation = "freenas.org/replication-target"
+
+	defaultReplicationSchedule = "@hourly"
+)
+
+// replicationTarget is a second server datasets are replicated to
+type replicationTarget struct {
+	SecretName     string
+	SshCredentials int
+	TargetDataset  string
+}
+
+// GetReplicationTarget returns the replication target described by the given secret
+// sshCredentials is the id of the SSH connection to the target on the source server
+func (p *freenasProvisioner) GetReplicationTarget(ctx context.Context, secretNamespace, secretName string) (*replicationTarget, error) {
+	secret, err := p.GetSecret(ctx, secretNamespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &replicationTarget{
+		SecretName: secretName,
+	}
+	for k, v := range secret.Data {
+		switch k {
+		case "sshCredentials":
+			target.SshCredentials, err = strconv.Atoi(BytesToString(v))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid sshCredentials in replication target secret \"%s\"", secretName)
+			}
+		case "targetDataset":
+			target.TargetDataset = BytesToString(v)
+		}
+	}
+
+	if target.SshCredentials == 0 || target.TargetDataset == "" {
+		return nil, fmt.Errorf("Replication target secret \"%s\" must declare sshCredentials and targetDataset", secretName)
+	}
+
+	return target, nil
+}
+
+// replicationTargetName returns the replication target secret of a claim, if any
+func replicationTargetName(config *freenasProvisionerConfig, annotations map[string]string) string {
+	if v, ok := annotations[ReplicationTargetAnnotation]; ok {
+		return v
+	}
+	return config.ReplicationTarget
+}
+
+// replicationTask returns the task pushing the snapshots of dataset taken by snapshotTaskId to targetDataset
+func replicationTask(name, dataset, targetDataset string, sshCredentials, snapshotTaskId int) *freenas.ReplicationTask {
+	return &freenas.ReplicationTask{
+		Name:                  TruncateString(name, 120),
+		Direction:             "PUSH",
+		Transport:             "SSH",
+		SshCredentials:        sshCredentials,
+		SourceDatasets:        []string{dataset},
+		TargetDataset:         targetDataset,
+		Recursive:             false,
+		PeriodicSnapshotTasks: []int{snapshotTaskId},
+		RetentionPolicy:       "SOURCE",
+		Auto:                  true,
+		Enabled:               true,
+	}
+}
+
+// replicationState returns the state of a replication task as reported by FreeNAS
+func replicationState(task *freenas.ReplicationTask) string {
+	if task.State.State == "" {
+		return "PENDING"
+	}
+	return task.State.State
+}
+
+// DeleteReplica deletes the replica of a dataset on the server of the given replication target
+func (p *freenasProvisioner) DeleteReplica(ctx context.Context, log logr.Logger, secretNamespace, secretName, dataset string) error {
+	target, err := p.GetServerConfig(ctx, secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+
+	targetServer, err := p.GetServer(*target)
+	if err != nil {
+		return err
+	}
+	targetServer = targetServer.WithContext(ctx)
+
+	ds := freenas.Dataset{
+		Name: dataset,
+	}
+	err = ds.Get(targetServer)
+	if err != nil {
+		log.Info("Could not find replica on target, already deleted?", "replica", dataset, "replicationTarget", secretName)
+		return nil
+	}
+
+	log.Info("Deleting replica", "replica", dataset, "replicationTarget", secretName)
+	err = ds.Delete(targetServer)
+	if err != nil {
+		return fmt.Errorf("Cannot delete replica \"%s\" on target \"%s\". Error: %v", dataset, secretName, err)
+	}
+
+	return nil
+}
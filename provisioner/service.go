@@ -0,0 +1,106 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	nfsServiceStopped   = "NFS service is not running"
+	nfsServiceNotOnBoot = "NFS service is not started on boot, it will be stopped after a reboot"
+)
+
+// CheckNfsServices warns about FreeNAS servers used by the StorageClasses of the provisioner
+// whose NFS service is stopped or misconfigured
+func CheckNfsServices(ctx context.Context, client kubernetes.Interface, identifier string, recorder record.EventRecorder, provisionerName string) {
+	p := newFreenasProvisioner(client, identifier, recorder)
+
+	classes, err := client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logging.Log.Error(err, "Cannot check NFS services, unable to list StorageClasses")
+		return
+	}
+
+	for _, class := range classes.Items {
+		if class.Provisioner != provisionerName {
+			continue
+		}
+
+		config, err := p.GetConfig(ctx, class.Name)
+		if err != nil {
+			logging.Log.Error(err, "Cannot check NFS service", "storageclass", class.Name)
+			continue
+		}
+
+		for _, secretName := range config.ServerSecretNames {
+			backendConfig, err := p.GetBackendConfig(ctx, class.Name, secretName)
+			if err != nil {
+				logging.Log.Error(err, "Cannot check NFS service", "storageclass", class.Name)
+				continue
+			}
+
+			for _, msg := range p.checkNfsService(class, backendConfig) {
+				logging.Log.Error(errors.New(msg), "NFS service check failed", "storageclass", class.Name, "backend", backendConfig.ServerSecretName, "host", backendConfig.ServerHost)
+				p.Recorder.Eventf(&class, v1.EventTypeWarning, "NfsServiceMisconfigured", "%s (backend \"%s\", host \"%s\")", msg, backendConfig.ServerSecretName, backendConfig.ServerHost)
+			}
+		}
+	}
+}
+
+// checkNfsService returns the problems found on the NFS service of a backend
+func (p *freenasProvisioner) checkNfsService(class storagev1.StorageClass, config *freenasProvisionerConfig) []string {
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	service := freenas.Service{Name: "nfs"}
+	err = service.Get(freenasServer)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var msgs []string
+	if !service.Running() {
+		msgs = append(msgs, nfsServiceStopped)
+	}
+	if !service.Enabled {
+		msgs = append(msgs, nfsServiceNotOnBoot)
+	}
+
+	nfs := freenas.NfsService{}
+	err = nfs.Get(freenasServer)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+
+	if version, ok := MountOption(class.MountOptions, "vers", "nfsvers"); ok && strings.HasPrefix(version, "4") {
+		if !nfs.V4 {
+			msgs = append(msgs, "NFSv4 is used by mount options but is not enabled on the NFS service")
+		} else if !nfs.V4V3Owner {
+			msgs = append(msgs, "NFSv4 is used without the 'NFSv3 ownership model for NFSv4' option, ownership may be shown as nobody")
+		}
+	}
+
+	if strings.HasPrefix(config.ShareSecurity, "krb5") && !nfs.V4Krb {
+		msgs = append(msgs, "Kerberos security is used but 'Require Kerberos for NFSv4' is not enabled on the NFS service")
+	}
+
+	proto, _ := MountOption(class.MountOptions, "proto")
+	if _, udp := MountOption(class.MountOptions, "udp"); udp || proto == "udp" {
+		if !nfs.Udp {
+			msgs = append(msgs, "UDP is used by mount options but is not enabled on the NFS service")
+		}
+	}
+
+	return msgs
+}
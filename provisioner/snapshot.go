@@ -0,0 +1,220 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	SnapshotScheduleAnnotation  = "freenas.org/snapshot-schedule"
+	SnapshotRetentionAnnotation = "freenas.org/snapshot-retention"
+
+	// not the FreeNAS default (auto-), so the pruner never deletes snapshots taken by other tasks
+	snapshotNamingSchema     = snapshotNamePrefix + "%Y-%m-%d_%H-%M"
+	snapshotNamePrefix       = "freenas-provisioner-"
+	defaultSnapshotRetention = "2w"
+)
+
+var (
+	snapshotScheduleMacros = map[string]string{
+		"@hourly":  "0 * * * *",
+		"@daily":   "0 0 * * *",
+		"@weekly":  "0 0 * * 0",
+		"@monthly": "0 0 1 * *",
+	}
+	snapshotLifetimeUnits = map[string]string{
+		"h": "HOUR",
+		"d": "DAY",
+		"w": "WEEK",
+		"m": "MONTH",
+		"y": "YEAR",
+	}
+)
+
+// ParseSnapshotSchedule parses a cron schedule (minute hour dom month dow)
+// or one of the @hourly, @daily, @weekly and @monthly macros
+func ParseSnapshotSchedule(str string) (*freenas.Schedule, error) {
+	if macro, ok := snapshotScheduleMacros[str]; ok {
+		str = macro
+	}
+
+	fields := strings.Fields(str)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid snapshot schedule \"%s\", expected 5 cron fields (minute hour dom month dow)", str)
+	}
+
+	return &freenas.Schedule{
+		Minute: fields[0],
+		Hour:   fields[1],
+		Dom:    fields[2],
+		Month:  fields[3],
+		Dow:    fields[4],
+	}, nil
+}
+
+// ParseSnapshotRetention parses a retention given either as a count of snapshots (e.g. 10)
+// or as a duration (e.g. 12h, 7d, 2w, 6m, 1y), returns the count or the lifetime
+func ParseSnapshotRetention(str string) (int, int, string, error) {
+	if count, err := strconv.Atoi(str); err == nil {
+		if count <= 0 {
+			return 0, 0, "", fmt.Errorf("Invalid snapshot retention \"%s\", count must be positive", str)
+		}
+		return count, 0, "", nil
+	}
+
+	if len(str) < 2 {
+		return 0, 0, "", fmt.Errorf("Invalid snapshot retention \"%s\"", str)
+	}
+
+	value, err := strconv.Atoi(str[:len(str)-1])
+	unit, ok := snapshotLifetimeUnits[str[len(str)-1:]]
+	if err != nil || !ok || value <= 0 {
+		return 0, 0, "", fmt.Errorf("Invalid snapshot retention \"%s\", expected a count or a duration (h, d, w, m or y)", str)
+	}
+
+	return 0, value, unit, nil
+}
+
+// snapshotTask returns the periodic snapshot task of a dataset according to the class
+// and the claim annotations, and the retention count (0 if retention is a duration)
+// nil is returned if no schedule is set
+func snapshotTask(config *freenasProvisionerConfig, annotations map[string]string, dataset string) (*freenas.SnapshotTask, int, error) {
+	schedule, retention := config.SnapshotSchedule, config.SnapshotRetention
+	if v, ok := annotations[SnapshotScheduleAnnotation]; ok {
+		schedule = v
+	}
+	if v, ok := annotations[SnapshotRetentionAnnotation]; ok {
+		retention = v
+	}
+
+	if schedule == "" {
+		return nil, 0, nil
+	}
+
+	s, err := ParseSnapshotSchedule(schedule)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count, lifetimeValue, lifetimeUnit, err := ParseSnapshotRetention(retention)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count > 0 {
+		// expired snapshots are pruned by the provisioner
+		lifetimeValue, lifetimeUnit = 10, "YEAR"
+	}
+
+	return &freenas.SnapshotTask{
+		Dataset:       dataset,
+		Recursive:     false,
+		LifetimeValue: lifetimeValue,
+		LifetimeUnit:  lifetimeUnit,
+		NamingSchema:  snapshotNamingSchema,
+		Schedule:      *s,
+		Enabled:       true,
+	}, count, nil
+}
+
+// SnapshotPruner periodically deletes the oldest automatic snapshots
+// of volumes whose retention is a count of snapshots
+type SnapshotPruner struct {
+	provisioner *freenasProvisioner
+	interval    time.Duration
+}
+
+func NewSnapshotPruner(client kubernetes.Interface, identifier string, recorder record.EventRecorder, interval time.Duration) *SnapshotPruner {
+	return &SnapshotPruner{
+		provisioner: newFreenasProvisioner(client, identifier, recorder),
+		interval:    interval,
+	}
+}
+
+// Run prunes snapshots until the context is done
+func (s *SnapshotPruner) Run(ctx context.Context) {
+	logging.Log.Info("Starting snapshot pruner", "interval", s.interval.String())
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.prune(ctx)
+		if err != nil {
+			logging.Log.Error(err, "Cannot prune snapshots")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *SnapshotPruner) prune(ctx context.Context) error {
+	pvs, err := s.provisioner.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, pv := range pvs.Items {
+		count, _ := strconv.Atoi(pv.Annotations["snapshotRetentionCount"])
+		if pv.Annotations["freenasNFSProvisionerIdentity"] != s.provisioner.Identifier || count <= 0 {
+			continue
+		}
+
+		config, err := s.provisioner.GetBackendConfig(ctx, pv.Spec.StorageClassName, pv.Annotations["serverSecretName"])
+		if err != nil {
+			logging.Log.Error(err, "Cannot prune snapshots", "pv", pv.Name)
+			continue
+		}
+
+		freenasServer, err := s.provisioner.GetServer(*config)
+		if err != nil {
+			return err
+		}
+
+		err = s.provisioner.PruneSnapshots(freenasServer, pv.Annotations["dataset"], count, config.DryRun, &pv)
+		if err != nil {
+			logging.Log.Error(err, "Cannot prune snapshots", "pv", pv.Name)
+		}
+	}
+
+	return nil
+}
+
+// PruneSnapshots deletes the oldest automatic snapshots of a dataset to only keep count of them,
+// in dry run mode the deletions are only logged (and recorded as events of object)
+func (p *freenasProvisioner) PruneSnapshots(server *freenas.FreenasServer, dataset string, count int, dryRun bool, object runtime.Object) error {
+	snapshots, err := freenas.ListSnapshots(server, dataset)
+	if err != nil {
+		return err
+	}
+
+	var auto []freenas.Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Dataset == dataset && strings.HasPrefix(snapshot.Name, snapshotNamePrefix) {
+			auto = append(auto, snapshot)
+		}
+	}
+
+	for i := 0; i < len(auto)-count; i++ {
+		server.Log.Info("Deleting expired snapshot", "snapshot", auto[i].Id)
+		snapshot := auto[i]
+		err = p.apply(server.Log, dryRun, object, snapshot.DeleteRequest(), func() error { return snapshot.Delete(server) })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// ParseTopology parses a comma-separated list of key=value topology labels
+// (e.g. "topology.kubernetes.io/zone=zone-a,topology.kubernetes.io/region=eu")
+func ParseTopology(str string) (map[string]string, error) {
+	topology := map[string]string{}
+	for _, label := range strings.Split(str, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid topology label \"%s\", expected key=value", label)
+		}
+		topology[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return topology, nil
+}
+
+// SelectBackend returns the configuration of the first backend of the class
+// matching the selected node (WaitForFirstConsumer) and the class' allowedTopologies
+func (p *freenasProvisioner) SelectBackend(ctx context.Context, log logr.Logger, options controller.ProvisionOptions, config *freenasProvisionerConfig) (*freenasProvisionerConfig, error) {
+	var nodeLabels map[string]string
+	if options.SelectedNode != nil {
+		nodeLabels = options.SelectedNode.Labels
+	}
+
+	var allowedTopologies []v1.TopologySelectorTerm
+	if options.StorageClass != nil {
+		allowedTopologies = options.StorageClass.AllowedTopologies
+	}
+
+	for _, secretName := range config.ServerSecretNames {
+		backendConfig := config
+		if secretName != config.ServerSecretName {
+			var err error
+			backendConfig, err = p.GetBackendConfig(ctx, *options.PVC.Spec.StorageClassName, secretName)
+			if err != nil {
+				log.Error(err, "Ignoring backend", "backend", secretName, "backendNamespace", config.ServerSecretNamespace)
+				continue
+			}
+		}
+
+		if topologyMatchesNode(backendConfig.ServerTopology, nodeLabels) && topologyIsAllowed(backendConfig.ServerTopology, allowedTopologies) {
+			if len(config.ServerSecretNames) > 1 {
+				log.Info("Selected backend", "backend", secretName, "backendNamespace", backendConfig.ServerSecretNamespace, "topology", backendConfig.ServerTopology)
+			}
+			return backendConfig, nil
+		}
+	}
+
+	if options.SelectedNode != nil {
+		return nil, fmt.Errorf("No backend among %v matches topology of node \"%s\"", config.ServerSecretNames, options.SelectedNode.Name)
+	}
+	return nil, fmt.Errorf("No backend among %v matches allowed topologies", config.ServerSecretNames)
+}
+
+// topologyMatchesNode returns true if all the backend topology labels are set on the node
+// A backend without topology or an unknown node (Immediate binding) always match
+func topologyMatchesNode(topology map[string]string, nodeLabels map[string]string) bool {
+	if nodeLabels == nil {
+		return true
+	}
+
+	for k, v := range topology {
+		if nodeValue, ok := nodeLabels[k]; !ok || nodeValue != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topologyIsAllowed returns true if the backend topology satisfies at least one term
+// A backend without topology is always allowed as its location is unknown
+func topologyIsAllowed(topology map[string]string, terms []v1.TopologySelectorTerm) bool {
+	if len(terms) == 0 || len(topology) == 0 {
+		return true
+	}
+
+	for _, term := range terms {
+		if topologyMatchesTerm(topology, term) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func topologyMatchesTerm(topology map[string]string, term v1.TopologySelectorTerm) bool {
+	for _, expr := range term.MatchLabelExpressions {
+		value, ok := topology[expr.Key]
+		if !ok || !containsString(expr.Values, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TopologyNodeAffinity returns a PV node affinity restricting usage
+// to the nodes located in the given topology (nil if topology is empty)
+func TopologyNodeAffinity(topology map[string]string) *v1.VolumeNodeAffinity {
+	if len(topology) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(topology))
+	for k := range topology {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var expressions []v1.NodeSelectorRequirement
+	for _, k := range keys {
+		expressions = append(expressions, v1.NodeSelectorRequirement{
+			Key:      k,
+			Operator: v1.NodeSelectorOpIn,
+			Values:   []string{topology[k]},
+		})
+	}
+
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{
+				{MatchExpressions: expressions},
+			},
+		},
+	}
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
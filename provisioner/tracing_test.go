@@ -0,0 +1,139 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nmaupu/freenas-provisioner/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+// checkSpans checks the last span recorded is named name, with attributes, and all the others
+// are its FreeNAS requests children, returns the children
+func checkSpans(t *testing.T, recorder *tracetest.SpanRecorder, name string, attributes map[attribute.Key]string) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	spans := recorder.Ended()
+	if len(spans) < 2 {
+		t.Fatalf("expected a %s span and its children, got %d spans", name, len(spans))
+	}
+
+	root := spans[len(spans)-1]
+	if root.Name() != name {
+		t.Fatalf("expected a %s span, got %s", name, root.Name())
+	}
+	if root.Parent().IsValid() {
+		t.Errorf("expected %s to be a root span", name)
+	}
+	got := spanAttributes(root)
+	for k, v := range attributes {
+		if got[k].AsString() != v {
+			t.Errorf("expected %s attribute %s=%q, got %q", name, k, v, got[k].AsString())
+		}
+	}
+
+	children := spans[:len(spans)-1]
+	for _, child := range children {
+		if child.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("expected span %s to be a child of %s", child.Name(), name)
+		}
+		childAttributes := spanAttributes(child)
+		if childAttributes["freenas.endpoint"].AsString() == "" {
+			t.Errorf("expected span %s to have a freenas.endpoint attribute", child.Name())
+		}
+		if childAttributes["http.status_code"].AsInt64() == 0 {
+			t.Errorf("expected span %s to have an http.status_code attribute", child.Name())
+		}
+	}
+
+	return children
+}
+
+func TestProvisionDeleteSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer tracing.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	nas := newFakeFreenas(t)
+	client := newFakeCluster(t, nas.Server, map[string]string{"datasetParentName": "tank"})
+	p := newTestProvisioner(client)
+	ctx := context.Background()
+
+	pv, _, err := p.Provision(ctx, provisionOptions(client, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children := checkSpans(t, recorder, "Provision", map[attribute.Key]string{
+		"k8s.pvc.name":          "data",
+		"k8s.namespace.name":    "default",
+		"k8s.pv.name":           "pvc-data",
+		"k8s.storageclass.name": "freenas",
+		"freenas.backend":       "freenas-nfs",
+		"freenas.dataset":       "tank/default/data",
+	})
+	// namespace dataset, then volume dataset
+	var created []string
+	for _, child := range children {
+		if child.Name() == "FreeNAS POST /api/v1.0/storage/dataset" {
+			attributes := spanAttributes(child)
+			if status := attributes["http.status_code"].AsInt64(); status != 201 {
+				t.Errorf("unexpected dataset creation status %d", status)
+			}
+			created = append(created, attributes["freenas.endpoint"].AsString())
+		}
+	}
+	if len(created) != 2 || created[0] != "/api/v1.0/storage/dataset/tank/" || created[1] != "/api/v1.0/storage/dataset/tank/default/" {
+		t.Errorf("unexpected dataset creation spans %v", created)
+	}
+
+	recorder = tracetest.NewSpanRecorder()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	pv.Spec.StorageClassName = "freenas"
+	err = p.Delete(ctx, pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSpans(t, recorder, "Delete", map[attribute.Key]string{
+		"k8s.pv.name":           "pvc-data",
+		"k8s.storageclass.name": "freenas",
+		"freenas.backend":       "freenas-nfs",
+		"freenas.dataset":       "tank/default/data",
+	})
+}
+
+func TestProvisionErrorSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer tracing.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	nas := newFakeFreenas(t)
+	client := newFakeCluster(t, nas.Server, map[string]string{"datasetParentName": "missing"})
+	p := newTestProvisioner(client)
+
+	_, _, err := p.Provision(context.Background(), provisionOptions(client, "data"))
+	if err == nil {
+		t.Fatal("expected provisioning to fail without parent dataset")
+	}
+
+	spans := recorder.Ended()
+	root := spans[len(spans)-1]
+	if root.Name() != "Provision" || root.Status().Code != codes.Error {
+		t.Errorf("expected a failed Provision span, got %s (%v)", root.Name(), root.Status())
+	}
+	child := spans[0]
+	if status := spanAttributes(child)["http.status_code"].AsInt64(); status != 404 || child.Status().Code != codes.Error {
+		t.Errorf("expected a failed parent dataset request, got status %d (%v)", status, child.Status())
+	}
+}
@@ -0,0 +1,281 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nmaupu/freenas-provisioner/freenas"
+	"github.com/nmaupu/freenas-provisioner/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+var (
+	volumeMetricsLabels = []string{"namespace", "persistentvolumeclaim", "persistentvolume", "storageclass"}
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "freenas_provisioner_volume_used_bytes",
+		Help: "Space used by the dataset of a volume, including snapshots",
+	}, volumeMetricsLabels)
+	volumeReferencedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "freenas_provisioner_volume_referenced_bytes",
+		Help: "Space referenced by the dataset of a volume",
+	}, volumeMetricsLabels)
+	volumeAvailableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "freenas_provisioner_volume_available_bytes",
+		Help: "Space available to the dataset of a volume",
+	}, volumeMetricsLabels)
+	volumeQuotaBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "freenas_provisioner_volume_quota_bytes",
+		Help: "Refquota of the dataset of a volume (0 if none)",
+	}, volumeMetricsLabels)
+	volumeUsageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "freenas_provisioner_volume_usage_errors_total",
+		Help: "Polls which could not get the usage of the volumes of a StorageClass backend",
+	}, []string{"storageclass", "backend"})
+)
+
+func init() {
+	prometheus.MustRegister(volumeUsedBytes, volumeReferencedBytes, volumeAvailableBytes, volumeQuotaBytes, volumeUsageErrors)
+}
+
+// UsagePoller periodically reports the usage of each provisioned dataset
+// as PV annotations and Prometheus gauges, along with its replication state
+type UsagePoller struct {
+	provisioner *freenasProvisioner
+	interval    time.Duration
+
+	// reported are the labels of the gauges of each volume, by PV name
+	reported map[string]prometheus.Labels
+}
+
+func NewUsagePoller(client kubernetes.Interface, identifier string, recorder record.EventRecorder, interval time.Duration) *UsagePoller {
+	return &UsagePoller{
+		provisioner: newFreenasProvisioner(client, identifier, recorder),
+		interval:    interval,
+	}
+}
+
+// Run polls usage until the context is done
+func (u *UsagePoller) Run(ctx context.Context) {
+	logging.Log.Info("Starting usage poller", "interval", u.interval.String())
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		err := u.poll(ctx)
+		if err != nil {
+			logging.Log.Error(err, "Cannot poll volumes usage")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *UsagePoller) poll(ctx context.Context) error {
+	pvs, err := u.provisioner.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	// datasets of each server, listed once per poll (nil if they could not be listed)
+	datasets := map[string]map[string]freenas.Dataset{}
+	configs := map[string]*freenasProvisionerConfig{}
+	// backends which failed during this poll
+	failed := map[string]bool{}
+	reported := map[string]prometheus.Labels{}
+
+	// the volumes of a failed backend keep their last values
+	fail := func(pv *v1.PersistentVolume, backendKey string) {
+		if !failed[backendKey] {
+			failed[backendKey] = true
+			volumeUsageErrors.WithLabelValues(pv.Spec.StorageClassName, pv.Annotations["serverSecretName"]).Inc()
+		}
+		if labels, ok := u.reported[pv.Name]; ok {
+			reported[pv.Name] = labels
+		}
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Annotations["freenasNFSProvisionerIdentity"] != u.provisioner.Identifier || pv.Annotations["dataset"] == "" {
+			continue
+		}
+
+		backendKey := pv.Spec.StorageClassName + "/" + pv.Annotations["serverSecretName"]
+		if failed[backendKey] {
+			fail(pv, backendKey)
+			continue
+		}
+		config, ok := configs[backendKey]
+		if !ok {
+			config, err = u.provisioner.GetBackendConfig(ctx, pv.Spec.StorageClassName, pv.Annotations["serverSecretName"])
+			if err != nil {
+				logging.Log.Error(err, "Cannot get usage", "pv", pv.Name)
+				fail(pv, backendKey)
+				continue
+			}
+			configs[backendKey] = config
+		}
+
+		serverKey := fmt.Sprintf("%s:%d", config.ServerHost, config.ServerPort)
+		serverDatasets, ok := datasets[serverKey]
+		if !ok {
+			serverDatasets, err = u.listDatasets(config)
+			if err != nil {
+				logging.Log.Error(err, "Cannot list datasets", "server", serverKey)
+			}
+			datasets[serverKey] = serverDatasets
+		}
+		if serverDatasets == nil {
+			fail(pv, backendKey)
+			continue
+		}
+
+		ds, ok := serverDatasets[pv.Annotations["dataset"]]
+		if !ok {
+			continue
+		}
+
+		labels := volumeLabels(pv)
+		reported[pv.Name] = labels
+		err = u.report(ctx, pv, labels, config, &ds)
+		if err != nil {
+			logging.Log.Error(err, "Cannot report usage", "pv", pv.Name)
+		}
+	}
+
+	// drop the series of the volumes deleted, rebound or whose dataset is gone
+	for name, labels := range u.reported {
+		if current, ok := reported[name]; !ok || !sameLabels(current, labels) {
+			volumeUsedBytes.Delete(labels)
+			volumeReferencedBytes.Delete(labels)
+			volumeAvailableBytes.Delete(labels)
+			volumeQuotaBytes.Delete(labels)
+		}
+	}
+	u.reported = reported
+
+	return nil
+}
+
+// listDatasets returns the datasets of the server of a backend, by name
+func (u *UsagePoller) listDatasets(config *freenasProvisionerConfig) (map[string]freenas.Dataset, error) {
+	freenasServer, err := u.provisioner.GetServer(*config)
+	if err != nil {
+		return nil, err
+	}
+	list, err := freenas.ListDatasets(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := map[string]freenas.Dataset{}
+	for _, ds := range list {
+		datasets[ds.Name] = ds
+	}
+	return datasets, nil
+}
+
+// volumeLabels returns the labels of the gauges of a volume
+func volumeLabels(pv *v1.PersistentVolume) prometheus.Labels {
+	var namespace, claim string
+	if pv.Spec.ClaimRef != nil {
+		namespace, claim = pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+	}
+
+	return prometheus.Labels{
+		"namespace":             namespace,
+		"persistentvolumeclaim": claim,
+		"persistentvolume":      pv.Name,
+		"storageclass":          pv.Spec.StorageClassName,
+	}
+}
+
+func sameLabels(a, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *UsagePoller) report(ctx context.Context, pv *v1.PersistentVolume, labels prometheus.Labels, config *freenasProvisionerConfig, ds *freenas.Dataset) error {
+	volumeUsedBytes.With(labels).Set(float64(ds.Used))
+	volumeReferencedBytes.With(labels).Set(float64(ds.Refer))
+	volumeAvailableBytes.With(labels).Set(float64(ds.Avail))
+	volumeQuotaBytes.With(labels).Set(float64(ds.Refquota))
+
+	annotations := map[string]string{
+		"datasetUsed":  strconv.FormatInt(ds.Used, 10),
+		"datasetRefer": strconv.FormatInt(ds.Refer, 10),
+		"datasetAvail": strconv.FormatInt(ds.Avail, 10),
+	}
+
+	if config.UsageWarningPercent > 0 && ds.Refquota > 0 {
+		percent := float64(ds.Refer) * 100 / float64(ds.Refquota)
+		warning := percent >= config.UsageWarningPercent
+		if warning && pv.Annotations["usageWarning"] != "true" && pv.Spec.ClaimRef != nil {
+			u.provisioner.Recorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeWarning, "VolumeUsageHigh",
+				"Volume \"%s\" is %.0f%% full (%s of %s)", pv.Name, percent, bytefmt.ByteSize(uint64(ds.Refer)), bytefmt.ByteSize(uint64(ds.Refquota)))
+		}
+		annotations["usageWarning"] = strconv.FormatBool(warning)
+	}
+
+	replicationTaskId, _ := strconv.Atoi(pv.Annotations["replicationTaskId"])
+	if replicationTaskId > 0 {
+		freenasServer, err := u.provisioner.GetServer(*config)
+		if err != nil {
+			return err
+		}
+		replication := freenas.ReplicationTask{Id: replicationTaskId}
+		err = replication.Get(freenasServer)
+		if err != nil {
+			return err
+		}
+		state := replicationState(&replication)
+		if state == "ERROR" && pv.Annotations["replicationState"] != state && pv.Spec.ClaimRef != nil {
+			u.provisioner.Recorder.Eventf(pv.Spec.ClaimRef, v1.EventTypeWarning, "ReplicationFailed",
+				"Replication of volume \"%s\" failed: %s", pv.Name, replication.State.Error)
+		}
+		annotations["replicationState"] = state
+	}
+
+	changed := false
+	for k, v := range annotations {
+		if pv.Annotations[k] != v {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = u.provisioner.Client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}